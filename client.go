@@ -0,0 +1,136 @@
+package devmapper
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"sync/atomic"
+)
+
+// DefaultControlPath is the path of the device mapper control node
+const DefaultControlPath = "/dev/mapper/control"
+
+var errClientClosed = fmt.Errorf("devmapper client is closed")
+
+// defaultClient is used by the package-level functions
+var defaultClient = &Client{controlPath: DefaultControlPath}
+
+// Transport executes device mapper ioctls. data contains struct dm_ioctl header followed by
+// the command payload. The implementation writes the output back into data the same way
+// the kernel does and returns syscall.Errno on failure.
+// The default transport talks to the kernel via the control node, an alternative transport
+// (e.g. an in-memory fake) allows to use the library without device mapper kernel support.
+type Transport interface {
+	Ioctl(cmd uintptr, data []byte) error
+	Close() error
+}
+
+// controlTransport executes ioctls on the device mapper control node
+type controlTransport struct {
+	control *os.File
+}
+
+func (t controlTransport) Ioctl(cmd uintptr, data []byte) error {
+	return ioctlFd(t.control.Fd(), cmd, data)
+}
+
+func (t controlTransport) Close() error {
+	return t.control.Close()
+}
+
+// Client executes device mapper operations using a control node that is opened once and reused
+// for all the operations. Client is safe for concurrent use by multiple goroutines.
+type Client struct {
+	controlPath string // empty if the client uses a custom transport
+
+	mu        sync.Mutex // protects transport and closed
+	transport Transport
+	closed    bool
+	inflight  sync.WaitGroup // ioctls in progress, the transport is closed once they finish
+
+	udevSync atomic.Int32 // UdevSync mode
+}
+
+// NewClient opens the device mapper control node at the given path. An empty path means DefaultControlPath.
+// A custom path is useful e.g. in containers that bind-mount the control node elsewhere.
+func NewClient(controlPath string) (*Client, error) {
+	if controlPath == "" {
+		controlPath = DefaultControlPath
+	}
+	c := &Client{controlPath: controlPath}
+	if err := c.open(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// NewClientWithTransport creates a client that executes ioctls using the given transport
+func NewClientWithTransport(t Transport) *Client {
+	return &Client{transport: t}
+}
+
+// Close closes the client transport. The client cannot be used after that.
+// Close waits for the ioctls in progress to finish, a blocking ioctl like WaitEvent delays it until the event arrives.
+func (c *Client) Close() error {
+	c.mu.Lock()
+	c.closed = true
+	t := c.transport
+	c.transport = nil
+	c.mu.Unlock()
+
+	if t == nil {
+		return nil
+	}
+	c.inflight.Wait()
+	return t.Close()
+}
+
+// open opens the control node if it is not opened yet
+func (c *Client) open() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.closed {
+		return errClientClosed
+	}
+	if c.transport != nil {
+		return nil
+	}
+	control, err := os.Open(c.controlPath)
+	if err != nil {
+		return err
+	}
+	c.transport = controlTransport{control: control}
+	return nil
+}
+
+// acquire returns the transport and holds a reference to it, the caller must call c.inflight.Done() once the ioctl is done
+func (c *Client) acquire() (Transport, error) {
+	if err := c.open(); err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.transport == nil {
+		return nil, errClientClosed // closed after open() returned
+	}
+	c.inflight.Add(1)
+	return c.transport, nil
+}
+
+// ioctl executes a device mapper ioctl using the client's transport.
+// The control node is opened lazily, so the default client does not fail if device mapper is not available yet.
+// No lock is held during the ioctl, so blocking ioctls do not stall other operations.
+func (c *Client) ioctl(cmd uintptr, data []byte) error {
+	t, err := c.acquire()
+	if err != nil {
+		return err
+	}
+	defer c.inflight.Done()
+
+	if err := t.Ioctl(cmd, data); err != nil {
+		return newError(cmd, data, err)
+	}
+	return nil
+}
@@ -0,0 +1,91 @@
+package devmapper
+
+import (
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sys/unix"
+)
+
+func TestClientClose(t *testing.T) {
+	t.Parallel()
+
+	_, err := NewClient(filepath.Join(t.TempDir(), "nonexistent"))
+	require.ErrorIs(t, err, os.ErrNotExist)
+
+	// a regular file instead of the control node, the ioctls fail but the client lifecycle can be tested
+	control := filepath.Join(t.TempDir(), "control")
+	require.NoError(t, os.WriteFile(control, nil, 0o600))
+
+	c, err := NewClient(control)
+	require.NoError(t, err)
+	_, err = c.List()
+	require.Error(t, err)
+	require.NotErrorIs(t, err, errClientClosed)
+
+	require.NoError(t, c.Close())
+	_, err = c.List()
+	require.ErrorIs(t, err, errClientClosed)
+	require.NoError(t, c.Close(), "closing the client twice is fine")
+}
+
+// blockingTransport blocks DM_DEV_WAIT until release is closed
+type blockingTransport struct {
+	waiting chan struct{}
+	release chan struct{}
+	closed  atomic.Bool
+}
+
+func (b *blockingTransport) Ioctl(cmd uintptr, data []byte) error {
+	if b.closed.Load() {
+		return unix.EBADF
+	}
+	if cmd == unix.DM_DEV_WAIT {
+		close(b.waiting)
+		<-b.release
+	}
+	return nil
+}
+
+func (b *blockingTransport) Close() error {
+	b.closed.Store(true)
+	return nil
+}
+
+func TestClientBlockingIoctl(t *testing.T) {
+	t.Parallel()
+
+	transport := &blockingTransport{waiting: make(chan struct{}), release: make(chan struct{})}
+	c := NewClientWithTransport(transport)
+	data := make([]byte, unix.SizeofDmIoctl)
+
+	waitDone := make(chan error)
+	go func() { waitDone <- c.ioctl(unix.DM_DEV_WAIT, data) }()
+	<-transport.waiting
+
+	require.NoError(t, c.ioctl(unix.DM_VERSION, make([]byte, unix.SizeofDmIoctl)), "a blocked ioctl does not stall other calls")
+
+	closeDone := make(chan error)
+	go func() { closeDone <- c.Close() }()
+	require.Eventually(t, func() bool {
+		return c.ioctl(unix.DM_VERSION, make([]byte, unix.SizeofDmIoctl)) == errClientClosed
+	}, time.Second, time.Millisecond)
+	require.False(t, transport.closed.Load(), "the transport is in use")
+
+	close(transport.release)
+	require.NoError(t, <-waitDone)
+	require.NoError(t, <-closeDone)
+	require.True(t, transport.closed.Load())
+}
+
+func TestClientTransportWithoutKeyring(t *testing.T) {
+	t.Parallel()
+
+	c := NewClientWithTransport(&blockingTransport{})
+	err := c.Load("test", 0, VerityTable{Length: 4096, RootHashSig: []byte("signature")})
+	require.ErrorContains(t, err, "does not support verity root hash signatures")
+}
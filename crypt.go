@@ -2,14 +2,18 @@ package devmapper
 
 import (
 	"crypto/aes"
+	"crypto/cipher"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/binary"
 	"encoding/hex"
 	"fmt"
 	"io/fs"
+	"math/bits"
 	"os"
+	"slices"
 	"strconv"
 	"strings"
-
-	"golang.org/x/crypto/xts"
 )
 
 const (
@@ -25,6 +29,9 @@ const (
 	CryptFlagNoReadWorkqueue = "no_read_workqueue"
 	// CryptFlagNoWriteWorkqueue is an equivalent of 'no_write_workqueue' crypt option
 	CryptFlagNoWriteWorkqueue = "no_write_workqueue"
+	// CryptFlagIVLargeSectors is an equivalent of 'iv_large_sectors' crypt option, IV is generated from
+	// the sector number in SectorSize units instead of 512 bytes units
+	CryptFlagIVLargeSectors = "iv_large_sectors"
 )
 
 // CryptTable represents information needed for 'crypt' target creation
@@ -71,18 +78,245 @@ func (c CryptTable) buildSpec() string {
 	return strings.Join(args, " ")
 }
 
+func parseCryptTable(start, length uint64, params string) (Table, error) {
+	fields, err := splitParams(params, 5)
+	if err != nil {
+		return nil, err
+	}
+
+	c := CryptTable{
+		Start:         start,
+		Length:        length,
+		Encryption:    fields[0],
+		BackendDevice: fields[3],
+	}
+
+	key := fields[1]
+	switch {
+	case strings.HasPrefix(key, ":"):
+		c.KeyID = key
+	case key == "-":
+		// empty key
+	default:
+		c.Key, err = hex.DecodeString(key)
+		if err != nil {
+			return nil, fmt.Errorf("invalid key") // hex decoding error contains a key symbol
+		}
+	}
+
+	c.IVTweak, err = strconv.ParseUint(fields[2], 10, 64)
+	if err != nil {
+		return nil, err
+	}
+	offset, err := strconv.ParseUint(fields[4], 10, 64)
+	if err != nil {
+		return nil, err
+	}
+	c.BackendOffset = offset * SectorSize
+
+	if len(fields) > 5 {
+		num, err := strconv.Atoi(fields[5])
+		if err != nil {
+			return nil, err
+		}
+		if num != len(fields)-6 {
+			return nil, fmt.Errorf("expected %d optional parameters, got %d", num, len(fields)-6)
+		}
+		for _, f := range fields[6:] {
+			if size, ok := strings.CutPrefix(f, "sector_size:"); ok {
+				c.SectorSize, err = strconv.ParseUint(size, 10, 64)
+				if err != nil {
+					return nil, err
+				}
+				continue
+			}
+			c.Flags = append(c.Flags, f)
+		}
+	}
+
+	return c, nil
+}
+
+// CryptStatus represents status of 'crypt' target. dm-crypt does not report any status information.
+type CryptStatus struct{}
+
+func parseCryptStatus(status string) (any, error) {
+	if status != "" {
+		return nil, fmt.Errorf("invalid crypt status '%s'", status)
+	}
+	return &CryptStatus{}, nil
+}
+
 type cryptVolume struct {
-	f          *os.File
-	offset     uint64
-	sectorSize uint64
-	cipher     *xts.Cipher
+	f              *os.File
+	offset         uint64
+	sectorSize     uint64
+	ivOffset       uint64
+	ivLargeSectors bool
+	cipher         *cryptCipher
 }
 
-func (c CryptTable) makeCipher() (*xts.Cipher, error) {
-	if c.Encryption != "aes-xts-plain64" {
+// cryptCipher encrypts sectors the same way dm-crypt does for the given cipher specification
+// "cipher-chainmode-ivmode[:ivopts]", e.g. "aes-xts-plain64" or "aes-cbc-essiv:sha256"
+type cryptCipher struct {
+	block     cipher.Block
+	chainMode string
+	tweak     cipher.Block                   // XTS tweak cipher
+	iv        func(iv []byte, sector uint64) // IV generator, nil for ECB
+}
+
+func (c CryptTable) makeCipher() (*cryptCipher, error) {
+	parts := strings.SplitN(c.Encryption, "-", 3)
+	if parts[0] != "aes" {
 		return nil, fmt.Errorf("unsupported cipher suite '%s'", c.Encryption)
 	}
-	return xts.NewCipher(aes.NewCipher, c.Key)
+	var chainMode, ivMode string
+	switch len(parts) {
+	case 1:
+		// legacy "aes" means "aes-cbc-plain"
+		chainMode, ivMode = "cbc", "plain"
+	case 2:
+		chainMode = parts[1]
+		if chainMode == "plain" {
+			chainMode, ivMode = "cbc", "plain"
+		}
+	case 3:
+		chainMode, ivMode = parts[1], parts[2]
+	}
+	if chainMode != "ecb" && ivMode == "" {
+		return nil, fmt.Errorf("cipher suite '%s' requires an IV mode", c.Encryption)
+	}
+
+	cc := &cryptCipher{chainMode: chainMode}
+	key := c.Key
+	switch chainMode {
+	case "cbc", "ecb":
+	case "xts":
+		if len(key)%2 != 0 {
+			return nil, fmt.Errorf("invalid key size for cipher suite '%s'", c.Encryption)
+		}
+		tweak, err := aes.NewCipher(key[len(key)/2:])
+		if err != nil {
+			return nil, err
+		}
+		cc.tweak = tweak
+		key = key[:len(key)/2]
+	default:
+		return nil, fmt.Errorf("unsupported chaining mode in cipher suite '%s'", c.Encryption)
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	cc.block = block
+
+	ivMode, ivOpts, _ := strings.Cut(ivMode, ":")
+	if ivOpts != "" && ivMode != "essiv" {
+		return nil, fmt.Errorf("IV mode '%s' does not accept options", ivMode)
+	}
+	switch ivMode {
+	case "":
+	case "plain":
+		cc.iv = func(iv []byte, sector uint64) {
+			binary.LittleEndian.PutUint32(iv, uint32(sector))
+		}
+	case "plain64":
+		cc.iv = func(iv []byte, sector uint64) {
+			binary.LittleEndian.PutUint64(iv, sector)
+		}
+	case "plain64be":
+		cc.iv = func(iv []byte, sector uint64) {
+			binary.BigEndian.PutUint64(iv[len(iv)-8:], sector)
+		}
+	case "essiv":
+		// IV is plain64 encrypted with the hash of the key
+		if ivOpts != "sha256" {
+			return nil, fmt.Errorf("unsupported ESSIV hash '%s'", ivOpts)
+		}
+		salt := sha256.Sum256(c.Key)
+		essiv, err := aes.NewCipher(salt[:])
+		if err != nil {
+			return nil, err
+		}
+		cc.iv = func(iv []byte, sector uint64) {
+			binary.LittleEndian.PutUint64(iv, sector)
+			essiv.Encrypt(iv, iv)
+		}
+	case "benbi":
+		// big-endian count of the cipher blocks (starting from 1) in the last 8 bytes
+		shift := 9 - bits.TrailingZeros(aes.BlockSize)
+		cc.iv = func(iv []byte, sector uint64) {
+			binary.BigEndian.PutUint64(iv[len(iv)-8:], sector<<shift+1)
+		}
+	case "null":
+		cc.iv = func(iv []byte, sector uint64) {}
+	default:
+		return nil, fmt.Errorf("unsupported IV mode in cipher suite '%s'", c.Encryption)
+	}
+	if chainMode == "ecb" {
+		cc.iv = nil // ECB does not use IVs, the kernel ignores the IV mode
+	}
+	return cc, nil
+}
+
+func (c *cryptCipher) makeIV(sector uint64) []byte {
+	iv := make([]byte, aes.BlockSize)
+	if c.iv != nil {
+		c.iv(iv, sector)
+	}
+	return iv
+}
+
+// encrypt encrypts a single sector, sector is the IV sector number
+func (c *cryptCipher) encrypt(dst, src []byte, sector uint64) {
+	switch c.chainMode {
+	case "cbc":
+		cipher.NewCBCEncrypter(c.block, c.makeIV(sector)).CryptBlocks(dst, src)
+	case "xts":
+		c.xts(dst, src, sector, c.block.Encrypt)
+	case "ecb":
+		for i := 0; i < len(src); i += aes.BlockSize {
+			c.block.Encrypt(dst[i:], src[i:])
+		}
+	}
+}
+
+// decrypt decrypts a single sector, sector is the IV sector number
+func (c *cryptCipher) decrypt(dst, src []byte, sector uint64) {
+	switch c.chainMode {
+	case "cbc":
+		cipher.NewCBCDecrypter(c.block, c.makeIV(sector)).CryptBlocks(dst, src)
+	case "xts":
+		c.xts(dst, src, sector, c.block.Decrypt)
+	case "ecb":
+		for i := 0; i < len(src); i += aes.BlockSize {
+			c.block.Decrypt(dst[i:], src[i:])
+		}
+	}
+}
+
+// xts implements XTS mode (IEEE 1619) with the IV used as the tweak, the sector size is always a multiple
+// of the cipher block size so ciphertext stealing is never needed
+func (c *cryptCipher) xts(dst, src []byte, sector uint64, crypt func(dst, src []byte)) {
+	var tweak [aes.BlockSize]byte
+	c.tweak.Encrypt(tweak[:], c.makeIV(sector))
+
+	for i := 0; i < len(src); i += aes.BlockSize {
+		subtle.XORBytes(dst[i:i+aes.BlockSize], src[i:i+aes.BlockSize], tweak[:])
+		crypt(dst[i:], dst[i:])
+		subtle.XORBytes(dst[i:i+aes.BlockSize], dst[i:i+aes.BlockSize], tweak[:])
+
+		// multiply the tweak by x in GF(2^128)
+		var carry byte
+		for j := range tweak {
+			next := tweak[j] >> 7
+			tweak[j] = tweak[j]<<1 | carry
+			carry = next
+		}
+		if carry != 0 {
+			tweak[0] ^= 0x87
+		}
+	}
 }
 
 func (c CryptTable) openVolume(flag int, perm fs.FileMode) (Volume, error) {
@@ -106,7 +340,23 @@ func (c CryptTable) openVolume(flag int, perm fs.FileMode) (Volume, error) {
 	if err != nil {
 		return nil, err
 	}
-	return &cryptVolume{f: file, offset: c.BackendOffset, sectorSize: sectorSize, cipher: cipher}, nil
+	return &cryptVolume{
+		f:              file,
+		offset:         c.BackendOffset,
+		sectorSize:     sectorSize,
+		ivOffset:       c.IVTweak,
+		ivLargeSectors: slices.Contains(c.Flags, CryptFlagIVLargeSectors),
+		cipher:         cipher,
+	}, nil
+}
+
+// ivSector returns the sector number used for IV generation of the sector at the given offset
+func (c cryptVolume) ivSector(off uint64) uint64 {
+	sector := off/SectorSize + c.ivOffset
+	if c.ivLargeSectors {
+		sector /= c.sectorSize / SectorSize
+	}
+	return sector
 }
 
 func (c cryptVolume) ReadAt(buf []byte, off int64) (int, error) {
@@ -125,13 +375,10 @@ func (c cryptVolume) ReadAt(buf []byte, off int64) (int, error) {
 		return 0, err
 	}
 
-	sectorSize := int(c.sectorSize)
-	counter := uint64(off) / uint64(SectorSize)
-	for i := 0; i < int(length); i += sectorSize {
-		ciphertext := cryptBuf[i : i+sectorSize]
-		plaintext := buf[i : i+sectorSize]
-		c.cipher.Decrypt(plaintext, ciphertext, counter)
-		counter += c.sectorSize / SectorSize // if iv_large_sectors flag set then it should be counter+=1
+	for i := uint64(0); i < length; i += c.sectorSize {
+		ciphertext := cryptBuf[i : i+c.sectorSize]
+		plaintext := buf[i : i+c.sectorSize]
+		c.cipher.decrypt(plaintext, ciphertext, c.ivSector(offset+i))
 	}
 
 	return int(length), nil
@@ -148,14 +395,11 @@ func (c cryptVolume) WriteAt(buf []byte, off int64) (int, error) {
 		return 0, fmt.Errorf("offset must be multiple of CryptTable.SectorSize")
 	}
 
-	sectorSize := int(c.sectorSize)
-	counter := uint64(off) / uint64(SectorSize)
 	cryptBuf := make([]byte, length)
-	for i := 0; i < int(length); i += sectorSize {
-		ciphertext := cryptBuf[i : i+sectorSize]
-		plaintext := buf[i : i+sectorSize]
-		c.cipher.Encrypt(ciphertext, plaintext, counter)
-		counter += c.sectorSize / SectorSize // if iv_large_sectors flag set then it should be counter+=1
+	for i := uint64(0); i < length; i += c.sectorSize {
+		ciphertext := cryptBuf[i : i+c.sectorSize]
+		plaintext := buf[i : i+c.sectorSize]
+		c.cipher.encrypt(ciphertext, plaintext, c.ivSector(offset+i))
 	}
 
 	return c.f.WriteAt(cryptBuf, off+int64(c.offset))
@@ -0,0 +1,133 @@
+package devmapper
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/xts"
+)
+
+func TestCryptCipher(t *testing.T) {
+	t.Parallel()
+
+	key := make([]byte, 32)
+	_, _ = rand.Read(key)
+	plaintext := make([]byte, 4*SectorSize)
+	_, _ = rand.Read(plaintext)
+	const sector = 0x0102030405
+
+	cbc := func(key, iv []byte) []byte {
+		block, err := aes.NewCipher(key)
+		require.NoError(t, err)
+		out := make([]byte, len(plaintext))
+		cipher.NewCBCEncrypter(block, iv).CryptBlocks(out, plaintext)
+		return out
+	}
+	iv := func(f func(iv []byte)) []byte {
+		iv := make([]byte, aes.BlockSize)
+		f(iv)
+		return iv
+	}
+
+	xtsCipher, err := xts.NewCipher(aes.NewCipher, key)
+	require.NoError(t, err)
+	xtsPlain64 := make([]byte, len(plaintext))
+	xtsCipher.Encrypt(xtsPlain64, plaintext, sector)
+	xtsPlain := make([]byte, len(plaintext))
+	xtsCipher.Encrypt(xtsPlain, plaintext, sector&0xffffffff)
+
+	essivKey := sha256.Sum256(key)
+	essivBlock, err := aes.NewCipher(essivKey[:])
+	require.NoError(t, err)
+	essivIV := iv(func(iv []byte) { binary.LittleEndian.PutUint64(iv, sector) })
+	essivBlock.Encrypt(essivIV, essivIV)
+
+	ecb := make([]byte, len(plaintext))
+	block, err := aes.NewCipher(key)
+	require.NoError(t, err)
+	for i := 0; i < len(plaintext); i += aes.BlockSize {
+		block.Encrypt(ecb[i:], plaintext[i:])
+	}
+
+	tests := []struct {
+		encryption string
+		expected   []byte
+	}{
+		{"aes-xts-plain64", xtsPlain64},
+		{"aes-xts-plain", xtsPlain},
+		{"aes-cbc-plain", cbc(key, iv(func(iv []byte) { binary.LittleEndian.PutUint32(iv, 0x02030405) }))},
+		{"aes", cbc(key, iv(func(iv []byte) { binary.LittleEndian.PutUint32(iv, 0x02030405) }))},
+		{"aes-cbc-plain64", cbc(key, iv(func(iv []byte) { binary.LittleEndian.PutUint64(iv, sector) }))},
+		{"aes-cbc-plain64be", cbc(key, iv(func(iv []byte) { binary.BigEndian.PutUint64(iv[8:], sector) }))},
+		{"aes-cbc-benbi", cbc(key, iv(func(iv []byte) { binary.BigEndian.PutUint64(iv[8:], sector*32+1) }))},
+		{"aes-cbc-null", cbc(key, make([]byte, aes.BlockSize))},
+		{"aes-cbc-essiv:sha256", cbc(key, essivIV)},
+		{"aes-ecb", ecb},
+		{"aes-ecb-null", ecb},
+	}
+	for _, test := range tests {
+		c, err := CryptTable{Encryption: test.encryption, Key: key}.makeCipher()
+		require.NoError(t, err, test.encryption)
+
+		encrypted := make([]byte, len(plaintext))
+		c.encrypt(encrypted, plaintext, sector)
+		require.Equal(t, test.expected, encrypted, test.encryption)
+
+		decrypted := make([]byte, len(plaintext))
+		c.decrypt(decrypted, encrypted, sector)
+		require.Equal(t, plaintext, decrypted, test.encryption)
+	}
+
+	for _, encryption := range []string{"aes-cbc", "twofish-cbc-plain", "aes-cbc-essiv:md5", "aes-cbc-lmk", "aes-ctr-plain64", "aes-cbc-plain64:sha256"} {
+		_, err := CryptTable{Encryption: encryption, Key: key}.makeCipher()
+		require.Error(t, err, encryption)
+	}
+}
+
+func TestCryptUserspaceVolume(t *testing.T) {
+	t.Parallel()
+
+	key := make([]byte, 64)
+	_, _ = rand.Read(key)
+	data := make([]byte, 8*4096)
+	_, _ = rand.Read(data)
+	backend := filepath.Join(t.TempDir(), "backend")
+	require.NoError(t, os.WriteFile(backend, make([]byte, 1024+len(data)), 0o600))
+
+	c := CryptTable{
+		Length:        uint64(len(data)),
+		Encryption:    "aes-xts-plain64",
+		Key:           key,
+		BackendDevice: backend,
+		BackendOffset: 1024,
+		IVTweak:       16,
+		SectorSize:    4096,
+		Flags:         []string{CryptFlagIVLargeSectors},
+	}
+	vol, err := OpenUserspaceVolume(os.O_RDWR, 0, c)
+	require.NoError(t, err)
+	defer vol.Close()
+	_, err = vol.WriteAt(data, 0)
+	require.NoError(t, err)
+
+	// IV of the 3rd sector is (2*8 + 16) / 8 = 4 with iv_large_sectors
+	encrypted, err := os.ReadFile(backend)
+	require.NoError(t, err)
+	xtsCipher, err := xts.NewCipher(aes.NewCipher, key)
+	require.NoError(t, err)
+	sector := make([]byte, 4096)
+	xtsCipher.Decrypt(sector, encrypted[1024+2*4096:1024+3*4096], 4)
+	require.Equal(t, data[2*4096:3*4096], sector)
+
+	buf := make([]byte, 2*4096)
+	_, err = vol.ReadAt(buf, 4096)
+	require.NoError(t, err)
+	require.Equal(t, data[4096:3*4096], buf)
+}
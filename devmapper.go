@@ -1,8 +1,11 @@
 package devmapper
 
 import (
+	"errors"
 	"fmt"
 	"io/fs"
+	"strings"
+	"time"
 	"unsafe"
 
 	"golang.org/x/sys/unix"
@@ -25,118 +28,376 @@ type Table interface {
 	openVolume(flag int, perm fs.FileMode) (Volume, error)
 }
 
-var errNotImplemented = fmt.Errorf("not implemented")
+// Create is a wrapper around Client.Create that uses the default client.
+func Create(name string, uuid string) error {
+	return defaultClient.Create(name, uuid)
+}
 
 // Create creates a new device. No table will be loaded. The device will be in
 // suspended state. Any IO to this device will fail.
-func Create(name string, uuid string) error {
-	return ioctlTable(unix.DM_DEV_CREATE, name, uuid, 0, false, nil)
+func (c *Client) Create(name string, uuid string) error {
+	return c.ioctlTable(unix.DM_DEV_CREATE, name, uuid, 0, false, nil)
 }
 
-// CreateAndLoad creates, loads the provided tables and resumes the device.
+// CreateAndLoad is a wrapper around Client.CreateAndLoad that uses the default client.
 func CreateAndLoad(name string, uuid string, flags uint32, tables ...Table) error {
-	if err := Create(name, uuid); err != nil {
+	return defaultClient.CreateAndLoad(name, uuid, flags, tables...)
+}
+
+// CreateAndLoad creates, loads the provided tables and resumes the device.
+func (c *Client) CreateAndLoad(name string, uuid string, flags uint32, tables ...Table) error {
+	if err := c.Create(name, uuid); err != nil {
 		return err
 	}
-	if err := Load(name, flags, tables...); err != nil {
-		_ = Remove(name)
+	if err := c.Load(name, flags, tables...); err != nil {
+		_ = c.Remove(name)
 		return err
 	}
-	return Resume(name)
+	return c.Resume(name)
 }
 
-// Message passes a message string to the target at specific offset of a device.
-func Message(name string, sector int, message string) error {
-	return errNotImplemented
+// Message is a wrapper around Client.Message that uses the default client.
+func Message(name string, sector int, message string) (string, error) {
+	return defaultClient.Message(name, sector, message)
 }
 
-// Suspend suspends the given device.
+// Message passes a message string to the target at specific offset (in sectors) of a device.
+// Some targets (e.g. dm-stats '@stats_list', thin-pool, cache) reply to the message, in this case
+// the reply text is returned. For messages without a reply an empty string is returned.
+func (c *Client) Message(name string, sector int, message string) (string, error) {
+	// payload reflects struct dm_target_msg: sector followed by NUL-terminated message
+	const sizeofDmTargetMsg = int(unsafe.Sizeof(unix.DmTargetMsg{}))
+	payload := make([]byte, sizeofDmTargetMsg+len(message)+1)
+	(*unix.DmTargetMsg)(unsafe.Pointer(&payload[0])).Sector = uint64(sector)
+	copy(payload[sizeofDmTargetMsg:], message)
+
+	ioctlData, out, err := c.ioctlWithOutput(unix.DM_TARGET_MSG, name, "", 0, 0, payload)
+	if err != nil {
+		return "", err
+	}
+	if ioctlData.Flags&unix.DM_DATA_OUT_FLAG == 0 {
+		return "", nil
+	}
+	return fixedArrayToString(out), nil
+}
+
+// Suspend is a wrapper around Client.Suspend that uses the default client.
 func Suspend(name string) error {
-	return ioctlTable(unix.DM_DEV_SUSPEND, name, "", unix.DM_SUSPEND_FLAG, false, nil)
+	return defaultClient.Suspend(name)
 }
 
-// Resume resumes the given device.
+// Suspend suspends the given device.
+func (c *Client) Suspend(name string) error {
+	_, err := c.SuspendWithOptions(name, SuspendOptions{})
+	return err
+}
+
+// SuspendOptions controls SuspendWithOptions behavior
+type SuspendOptions struct {
+	NoFlush    bool // do not flush the queued I/O, e.g. for multipath devices with all paths down (DM_NOFLUSH_FLAG)
+	SkipLockfs bool // do not freeze the filesystem mounted on top of the device (DM_SKIP_LOCKFS_FLAG)
+}
+
+// SuspendWithOptions is a wrapper around Client.SuspendWithOptions that uses the default client.
+func SuspendWithOptions(name string, opts SuspendOptions) (bool, error) {
+	return defaultClient.SuspendWithOptions(name, opts)
+}
+
+// SuspendWithOptions suspends the given device and reports whether the device is suspended according to the flags
+// returned by the kernel. Note that an internal suspend (e.g. of thin devices while their pool is suspended) is
+// reported separately with DM_INTERNAL_SUSPEND_FLAG in DeviceInfo.Flags.
+func (c *Client) SuspendWithOptions(name string, opts SuspendOptions) (bool, error) {
+	flags := uint32(unix.DM_SUSPEND_FLAG)
+	if opts.NoFlush {
+		flags |= unix.DM_NOFLUSH_FLAG
+	}
+	if opts.SkipLockfs {
+		flags |= unix.DM_SKIP_LOCKFS_FLAG
+	}
+	ioctlData, _, err := c.ioctlWithOutput(unix.DM_DEV_SUSPEND, name, "", flags, 0, nil)
+	if err != nil {
+		return false, err
+	}
+	return ioctlData.Flags&unix.DM_SUSPEND_FLAG != 0, nil
+}
+
+// Resume is a wrapper around Client.Resume that uses the default client.
 func Resume(name string) error {
-	return ioctlTable(unix.DM_DEV_SUSPEND, name, "", 0, true, nil)
+	return defaultClient.Resume(name)
 }
 
-// Load loads given table into the device
+// Resume resumes the given device.
+func (c *Client) Resume(name string) error {
+	return c.ioctlTable(unix.DM_DEV_SUSPEND, name, "", 0, true, nil)
+}
+
+// Load is a wrapper around Client.Load that uses the default client.
 func Load(name string, flags uint32, tables ...Table) error {
+	return defaultClient.Load(name, flags, tables...)
+}
+
+// Load loads given table into the device
+func (c *Client) Load(name string, flags uint32, tables ...Table) error {
 	flags &= unix.DM_READONLY_FLAG
-	return ioctlTable(unix.DM_TABLE_LOAD, name, "", flags, false, tables)
+	k := c.keyring()
+	tables, keys, err := addRootHashSigKeys(k, name, tables)
+	if err != nil {
+		return err
+	}
+	// the kernel copies the root hash signature when the table is loaded, the keys are not needed after that
+	defer unlinkKeys(k, keys)
+	return c.ioctlTable(unix.DM_TABLE_LOAD, name, "", flags, false, tables)
 }
 
-// Rename renames the device
+// ReloadOptions controls Reload behavior
+type ReloadOptions struct {
+	Flags      uint32 // table flags, the same as for Load e.g. ReadOnlyFlag
+	NoFlush    bool   // do not flush the queued I/O while the device is suspended (DM_NOFLUSH_FLAG)
+	SkipLockfs bool   // do not freeze the filesystem mounted on top of the device (DM_SKIP_LOCKFS_FLAG)
+}
+
+// Reload is a wrapper around Client.Reload that uses the default client.
+func Reload(name string, opts ReloadOptions, tables ...Table) error {
+	return defaultClient.Reload(name, opts, tables...)
+}
+
+// Reload atomically replaces the live table of the device, e.g. to grow a linear device or to switch it to another
+// backing device. The new table is loaded as inactive, then the device is suspended and resumed, at this moment
+// the kernel swaps the tables.
+// If any step fails then the inactive table is cleared and the device keeps running with its old table.
+// A device that is suspended already is left suspended, the new table becomes live once the caller resumes it.
+func (c *Client) Reload(name string, opts ReloadOptions, tables ...Table) error {
+	info, err := c.InfoByName(name)
+	if err != nil {
+		return err
+	}
+	if err := c.Load(name, opts.Flags, tables...); err != nil {
+		return err
+	}
+	if info.Flags&unix.DM_SUSPEND_FLAG != 0 {
+		return nil
+	}
+
+	if _, err := c.SuspendWithOptions(name, SuspendOptions{NoFlush: opts.NoFlush, SkipLockfs: opts.SkipLockfs}); err != nil {
+		_ = c.clearTable(name)
+		return err
+	}
+
+	if err := c.Resume(name); err != nil {
+		// the kernel destroys the new table if it fails to swap it, the device stays suspended with the old table
+		_ = c.clearTable(name)
+		_ = c.Resume(name)
+		return err
+	}
+	return nil
+}
+
+// clearTable destroys the inactive table of the device
+func (c *Client) clearTable(name string) error {
+	return c.ioctlTable(unix.DM_TABLE_CLEAR, name, "", 0, false, nil)
+}
+
+// Rename is a wrapper around Client.Rename that uses the default client.
 func Rename(old, new string) error {
-	// primaryUdevEvent == true
-	return errNotImplemented
+	return defaultClient.Rename(old, new)
+}
+
+// Rename renames the device
+func (c *Client) Rename(old, new string) error {
+	if len(new) >= unix.DM_NAME_LEN {
+		return fmt.Errorf("device name '%s' is too long", new)
+	}
+	return c.rename(old, 0, new)
 }
 
-// SetUUID sets uuid for a given device
+// SetUUID is a wrapper around Client.SetUUID that uses the default client.
 func SetUUID(name, uuid string) error {
-	return errNotImplemented
+	return defaultClient.SetUUID(name, uuid)
 }
 
-// Remove removes the device and destroys its tables.
+// SetUUID sets uuid for a given device. The UUID can be set only once, if the device
+// already has a UUID then ErrUUIDAlreadySet is returned.
+func (c *Client) SetUUID(name, uuid string) error {
+	if len(uuid) >= unix.DM_UUID_LEN {
+		return fmt.Errorf("device uuid '%s' is too long", uuid)
+	}
+	info, err := c.InfoByName(name)
+	if err != nil {
+		return err
+	}
+	if info.UUID != "" {
+		return fmt.Errorf("%s: %w", name, ErrUUIDAlreadySet)
+	}
+	return c.rename(name, unix.DM_UUID_FLAG, uuid)
+}
+
+// rename changes the device name or, if DM_UUID_FLAG is set, the device uuid.
+func (c *Client) rename(name string, flags uint32, newValue string) error {
+	payload := make([]byte, len(newValue)+1) // NUL-terminated new name or uuid
+	copy(payload, newValue)
+	// rename is a primary udev event
+	return c.ioctlUdev(unix.DM_DEV_RENAME, name, flags, payload)
+}
+
+// Remove is a wrapper around Client.Remove that uses the default client.
 func Remove(name string) error {
-	return ioctlTable(unix.DM_DEV_REMOVE, name, "", 0, true, nil)
+	return defaultClient.Remove(name)
+}
+
+// Remove removes the device and destroys its tables.
+func (c *Client) Remove(name string) error {
+	return c.ioctlTable(unix.DM_DEV_REMOVE, name, "", 0, true, nil)
+}
+
+// RemoveOptions controls RemoveWithOptions behavior
+type RemoveOptions struct {
+	// Retries is the number of times the removal is retried if the device is busy. Right after creation
+	// the device is often briefly opened by udev workers or blkid, similar to 'dmsetup remove --retry'.
+	Retries int
+	// RetryDelay is the delay before the first retry, it is doubled after every retry. Default is 100ms.
+	RetryDelay time.Duration
+	// Deferred makes the kernel remove a busy device once it is closed by the last user (DM_DEFERRED_REMOVE).
+	// A deferred removal never fails with ErrBusy, so Retries is not used. It can be cancelled with CancelDeferredRemove.
+	Deferred bool
+}
+
+// RemoveWithOptions is a wrapper around Client.RemoveWithOptions that uses the default client.
+func RemoveWithOptions(name string, opts RemoveOptions) error {
+	return defaultClient.RemoveWithOptions(name, opts)
+}
+
+// RemoveWithOptions removes the device the same way as Remove but allows to retry the removal of a busy device
+// or to defer the removal until the device is closed.
+// If the removal is deferred then DeviceInfo.Flags of the device has DM_DEFERRED_REMOVE set until the device is removed.
+func (c *Client) RemoveWithOptions(name string, opts RemoveOptions) error {
+	if opts.Deferred {
+		return c.ioctlTable(unix.DM_DEV_REMOVE, name, "", unix.DM_DEFERRED_REMOVE, true, nil)
+	}
+
+	delay := opts.RetryDelay
+	if delay == 0 {
+		delay = 100 * time.Millisecond
+	}
+	for i := 0; ; i++ {
+		err := c.Remove(name)
+		if err == nil || i >= opts.Retries || !errors.Is(err, ErrBusy) {
+			return err
+		}
+		time.Sleep(delay)
+		delay *= 2
+	}
+}
+
+// CancelDeferredRemove is a wrapper around Client.CancelDeferredRemove that uses the default client.
+func CancelDeferredRemove(name string) error {
+	return defaultClient.CancelDeferredRemove(name)
+}
+
+// CancelDeferredRemove cancels a pending deferred removal of the device, see RemoveOptions.Deferred
+func (c *Client) CancelDeferredRemove(name string) error {
+	_, err := c.Message(name, 0, "@cancel_deferred_remove")
+	return err
 }
 
 // ListItem represents information about a dmsetup device
 type ListItem struct {
-	DevNo uint64
-	Name  string
+	DevNo   uint64
+	Name    string
+	UUID    string
+	EventNr uint32
 }
 
-// List provides a list of dmsetup devices
+// List is a wrapper around Client.List that uses the default client.
 func List() ([]ListItem, error) {
-	bufferSize := 4096
-
-retry:
-	data := make([]byte, bufferSize) // unix.SizeofDmIoctl info + space for output params
-	ioctlData := (*unix.DmIoctl)(unsafe.Pointer(&data[0]))
-	ioctlData.Version = [...]uint32{4, 0, 0} // minimum required version
-	ioctlData.Data_size = uint32(bufferSize)
-	ioctlData.Data_start = unix.SizeofDmIoctl
+	return defaultClient.List()
+}
 
-	if err := ioctl(unix.DM_LIST_DEVICES, data); err != nil {
+// List provides a list of dmsetup devices
+func (c *Client) List() ([]ListItem, error) {
+	// DM_UUID_FLAG asks kernel 4.45+ to report device UUIDs, older kernels ignore this flag
+	ioctlData, out, err := c.ioctlWithOutput(unix.DM_LIST_DEVICES, "", "", unix.DM_UUID_FLAG, 0, nil)
+	if err != nil {
 		return nil, err
 	}
 
-	if ioctlData.Flags&unix.DM_BUFFER_FULL_FLAG != 0 {
-		if bufferSize >= 1024*1024 { // 1 MB
-			return nil, fmt.Errorf("ioctl(DM_LIST_DEVICES): output data is too big")
+	result, incomplete := parseNameList(out, ioctlData.Version)
+	for _, i := range incomplete {
+		// older kernel that does not report UUIDs and event numbers, fallback to per-device query
+		info, err := c.InfoByDevno(result[i].DevNo)
+		if errors.Is(err, ErrNotFound) {
+			continue // the device has been removed in the meantime
 		}
-		bufferSize *= 4
-		goto retry // retry with bigger buffer
+		if err != nil {
+			return nil, err
+		}
+		result[i].UUID = info.UUID
+		result[i].EventNr = info.EventNr
 	}
 
-	result := make([]ListItem, 0)
+	return result, nil
+}
 
+// parseNameList parses output of DM_LIST_DEVICES, a chain of struct dm_name_list.
+// version is the kernel's device mapper interface version. It returns the list of devices and
+// indexes of the items that miss the UUID information.
+func parseNameList(out []byte, version [3]uint32) ([]ListItem, []int) {
+	const (
+		alignment = 8
+		nameStart = 12 // sum of the dmNameList fields, at this offset "name" field starts
+	)
 	type dmNameList struct { // reflects struct dm_name_list
 		devNo      uint64
 		offsetNext uint32
 	}
-	offset := ioctlData.Data_start
-	for offset < ioctlData.Data_size {
-		item := (*dmNameList)(unsafe.Pointer(&data[offset]))
-		nameData := data[offset+12:] // 12 is sum of the dmNameList fields, at this offset "name" field starts
-		if item.offsetNext != 0 {
-			nameData = nameData[:item.offsetNext] // make sure that nameData never captures data from the next item
+
+	// kernel 4.37+ puts event_nr after the name, kernel 4.45+ puts flags and uuid after the event_nr
+	hasEventNr := version[1] >= 37
+	hasUUID := version[1] >= 45
+
+	result := make([]ListItem, 0)
+	var incomplete []int
+	offset := 0
+	for offset+nameStart <= len(out) {
+		item := (*dmNameList)(unsafe.Pointer(&out[offset]))
+		if item.devNo == 0 {
+			break // no devices
 		}
+		itemData := out[offset:]
+		if item.offsetNext != 0 && int(item.offsetNext) <= len(itemData) {
+			itemData = itemData[:item.offsetNext] // make sure that itemData never captures data from the next item
+		}
+		name := fixedArrayToString(itemData[nameStart:])
 		dev := ListItem{
 			DevNo: item.devNo,
-			Name:  fixedArrayToString(nameData),
+			Name:  name,
+		}
+
+		complete := false
+		eventOffset := roundUp(nameStart+len(name)+1, alignment)
+		if hasEventNr && eventOffset+8 <= len(itemData) {
+			dev.EventNr = *(*uint32)(unsafe.Pointer(&itemData[eventOffset]))
+			flags := *(*uint32)(unsafe.Pointer(&itemData[eventOffset+4]))
+			switch {
+			case !hasUUID:
+			case flags&unix.DM_NAME_LIST_FLAG_HAS_UUID != 0:
+				dev.UUID = fixedArrayToString(itemData[eventOffset+8:])
+				complete = true
+			case flags&unix.DM_NAME_LIST_FLAG_DOESNT_HAVE_UUID != 0:
+				complete = true
+			}
+		}
+		if !complete {
+			incomplete = append(incomplete, len(result))
 		}
 		result = append(result, dev)
 
 		if item.offsetNext == 0 {
 			break
 		}
-		offset += item.offsetNext
+		offset += int(item.offsetNext)
 	}
 
-	return result, nil
+	return result, incomplete
 }
 
 // DeviceInfo is a type that holds devmapper device information
@@ -147,28 +408,80 @@ type DeviceInfo struct {
 	OpenCount  int32
 	TargetsNum uint32
 	Flags      uint32 // combination of unix.DM_*_FLAG
+	EventNr    uint32 // device event counter, incremented every time a target raises an event
 }
 
-// InfoByName returns device information by its name
+// InfoByName is a wrapper around Client.InfoByName that uses the default client.
 func InfoByName(name string) (*DeviceInfo, error) {
-	return info(name, 0)
+	return defaultClient.InfoByName(name)
 }
 
-// InfoByDevno returns device mapper information by its block device number (major/minor)
+// InfoByName returns device information by its name
+func (c *Client) InfoByName(name string) (*DeviceInfo, error) {
+	return c.info(name, "", 0)
+}
+
+// InfoByDevno is a wrapper around Client.InfoByDevno that uses the default client.
 func InfoByDevno(devno uint64) (*DeviceInfo, error) {
-	return info("", devno)
+	return defaultClient.InfoByDevno(devno)
 }
 
-func info(name string, devno uint64) (*DeviceInfo, error) {
+// InfoByDevno returns device mapper information by its block device number (major/minor)
+func (c *Client) InfoByDevno(devno uint64) (*DeviceInfo, error) {
+	return c.info("", "", devno)
+}
+
+// InfoByUUID is a wrapper around Client.InfoByUUID that uses the default client.
+func InfoByUUID(uuid string) (*DeviceInfo, error) {
+	return defaultClient.InfoByUUID(uuid)
+}
+
+// InfoByUUID returns device information by its UUID
+func (c *Client) InfoByUUID(uuid string) (*DeviceInfo, error) {
+	if uuid == "" {
+		return nil, fmt.Errorf("empty device uuid")
+	}
+	return c.info("", uuid, 0)
+}
+
+// ListByUUIDPrefix is a wrapper around Client.ListByUUIDPrefix that uses the default client.
+func ListByUUIDPrefix(prefix string) ([]ListItem, error) {
+	return defaultClient.ListByUUIDPrefix(prefix)
+}
+
+// ListByUUIDPrefix returns devices which UUID starts with the given prefix.
+// Tagging devices with a subsystem prefix (like cryptsetup's "CRYPT-LUKS2-") allows to find the devices
+// owned by a service on a shared host.
+func (c *Client) ListByUUIDPrefix(prefix string) ([]ListItem, error) {
+	list, err := c.List()
+	if err != nil {
+		return nil, err
+	}
+
+	result := make([]ListItem, 0)
+	for _, l := range list {
+		if l.UUID != "" && strings.HasPrefix(l.UUID, prefix) {
+			result = append(result, l)
+		}
+	}
+	return result, nil
+}
+
+// info queries device status. The device is looked up either by name, uuid or devno, only one of them must be set.
+func (c *Client) info(name string, uuid string, devno uint64) (*DeviceInfo, error) {
 	data := make([]byte, unix.SizeofDmIoctl)
 	ioctlData := (*unix.DmIoctl)(unsafe.Pointer(&data[0]))
 	ioctlData.Version = [...]uint32{4, 0, 0} // minimum required version
 	copy(ioctlData.Name[:], name)
+	copy(ioctlData.Uuid[:], uuid)
+	if uuid != "" {
+		ioctlData.Flags = unix.DM_UUID_FLAG
+	}
 	ioctlData.Dev = devno
 	ioctlData.Data_size = unix.SizeofDmIoctl
 	ioctlData.Data_start = unix.SizeofDmIoctl
 
-	if err := ioctl(unix.DM_DEV_STATUS, data); err != nil {
+	if err := c.ioctl(unix.DM_DEV_STATUS, data); err != nil {
 		return nil, err
 	}
 
@@ -180,19 +493,59 @@ func info(name string, devno uint64) (*DeviceInfo, error) {
 		OpenCount:  ioctlData.Open_count,
 		TargetsNum: ioctlData.Target_count,
 		Flags:      ioctlData.Flags & flagsVisibleToUser,
+		EventNr:    ioctlData.Event_nr,
 	}
 	return &info, nil
 }
 
-// GetVersion returns version for the dm-mapper kernel interface
+// Deps is a wrapper around Client.Deps that uses the default client.
+func Deps(name string) ([]uint64, error) {
+	return defaultClient.Deps(name)
+}
+
+// Deps returns block device numbers (major/minor) of the devices the given device depends on
+// i.e. the devices used by its live table.
+func (c *Client) Deps(name string) ([]uint64, error) {
+	_, out, err := c.ioctlWithOutput(unix.DM_TABLE_DEPS, name, "", 0, 0, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(out) == 0 {
+		return []uint64{}, nil // the device has no table
+	}
+
+	// output reflects struct dm_target_deps: count, padding and then an array of dev_t
+	const sizeofDmTargetDeps = int(unsafe.Sizeof(unix.DmTargetDeps{}))
+	if len(out) < sizeofDmTargetDeps {
+		return nil, fmt.Errorf("dm ioctl DM_TABLE_DEPS %s: output data is truncated", name)
+	}
+	count := int((*unix.DmTargetDeps)(unsafe.Pointer(&out[0])).Count)
+	if len(out) < sizeofDmTargetDeps+count*8 {
+		return nil, fmt.Errorf("dm ioctl DM_TABLE_DEPS %s: output data is truncated", name)
+	}
+
+	deps := make([]uint64, count)
+	for i := range deps {
+		deps[i] = *(*uint64)(unsafe.Pointer(&out[sizeofDmTargetDeps+i*8]))
+	}
+	return deps, nil
+}
+
+// GetVersion is a wrapper around Client.GetVersion that uses the default client.
 func GetVersion() (major, minor, patch uint32, err error) {
+	return defaultClient.GetVersion()
+}
+
+// GetVersion returns version for the dm-mapper kernel interface
+func (c *Client) GetVersion() (major, minor, patch uint32, err error) {
 	data := make([]byte, unix.SizeofDmIoctl)
 	ioctlData := (*unix.DmIoctl)(unsafe.Pointer(&data[0]))
 	ioctlData.Version = [...]uint32{4, 0, 0} // minimum required version
 	ioctlData.Data_size = unix.SizeofDmIoctl
 	ioctlData.Data_start = unix.SizeofDmIoctl
 
-	if err := ioctl(unix.DM_VERSION, data); err != nil {
+	if err := c.ioctl(unix.DM_VERSION, data); err != nil {
 		return 0, 0, 0, err
 	}
 
@@ -0,0 +1,72 @@
+package devmapper
+
+import (
+	"encoding/binary"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sys/unix"
+)
+
+// buildNameList builds DM_LIST_DEVICES output the same way kernel 4.45+ does
+func buildNameList(items []ListItem, withUUID bool) []byte {
+	var out []byte
+	prev := -1
+	for _, item := range items {
+		offset := len(out)
+		if prev != -1 {
+			binary.LittleEndian.PutUint32(out[prev+8:], uint32(offset-prev))
+		}
+		prev = offset
+
+		entry := make([]byte, 12, 64)
+		binary.LittleEndian.PutUint64(entry, item.DevNo)
+		entry = append(entry, item.Name...)
+		entry = append(entry, 0)
+		entry = append(entry, make([]byte, roundUp(len(entry), 8)-len(entry))...)
+
+		var flags uint32
+		if withUUID {
+			flags = unix.DM_NAME_LIST_FLAG_DOESNT_HAVE_UUID
+			if item.UUID != "" {
+				flags = unix.DM_NAME_LIST_FLAG_HAS_UUID
+			}
+		}
+		entry = binary.LittleEndian.AppendUint32(entry, item.EventNr)
+		entry = binary.LittleEndian.AppendUint32(entry, flags)
+		if withUUID && item.UUID != "" {
+			entry = append(entry, item.UUID...)
+			entry = append(entry, 0)
+			entry = append(entry, make([]byte, roundUp(len(entry), 8)-len(entry))...)
+		}
+		out = append(out, entry...)
+	}
+	return out
+}
+
+func TestParseNameList(t *testing.T) {
+	t.Parallel()
+
+	items := []ListItem{
+		{DevNo: unix.Mkdev(253, 0), Name: "crypt", UUID: "CRYPT-LUKS2-2f144136b0de4b51b2ebbd869cc39a6e-crypt", EventNr: 3},
+		{DevNo: unix.Mkdev(253, 1), Name: "zero", EventNr: 0},
+		{DevNo: unix.Mkdev(253, 2), Name: "a-very-long-device-name", UUID: "u", EventNr: 17},
+	}
+
+	got, incomplete := parseNameList(buildNameList(items, true), [3]uint32{4, 48, 0})
+	require.Equal(t, items, got)
+	require.Empty(t, incomplete)
+
+	// older kernel reports event numbers but not UUIDs
+	got, incomplete = parseNameList(buildNameList(items, false), [3]uint32{4, 40, 0})
+	require.Len(t, got, 3)
+	require.Equal(t, "a-very-long-device-name", got[2].Name)
+	require.Equal(t, uint32(17), got[2].EventNr)
+	require.Equal(t, "", got[2].UUID)
+	require.Equal(t, []int{0, 1, 2}, incomplete)
+
+	// no devices
+	got, incomplete = parseNameList(make([]byte, 16), [3]uint32{4, 48, 0})
+	require.Empty(t, got)
+	require.Empty(t, incomplete)
+}
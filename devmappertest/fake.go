@@ -0,0 +1,911 @@
+// Package devmappertest provides an in-memory fake of the kernel device mapper. It allows to unit-test
+// code that uses devmapper.Client without root privileges and without device mapper kernel support:
+//
+//	fake := devmappertest.New()
+//	client := devmapper.NewClientWithTransport(fake)
+package devmappertest
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"regexp"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// Major is the block device major number of the fake devices
+const Major = 253
+
+// version is the device mapper interface version reported by the fake
+var version = [3]uint32{4, 48, 0}
+
+const (
+	alignment = 8
+	// offsetof(struct dm_ioctl, data), kernel resets data_size to this value before executing a command
+	sizeofDmIoctlHeader = unsafe.Offsetof(unix.DmIoctl{}.Data)
+	// kernel puts the output data at aligned position right after the header
+	outputStart = (unix.SizeofDmIoctl + alignment - 1) / alignment * alignment
+)
+
+// knownTargets is a list of target types accepted by the fake and the minimum number of their arguments
+var knownTargets = map[string]int{
+	"linear":          2,
+	"zero":            0,
+	"error":           0,
+	"crypt":           5,
+	"verity":          10,
+	"delay":           3,
+	"striped":         4,
+	"snapshot":        4,
+	"snapshot-origin": 1,
+	"thin-pool":       5,
+	"thin":            2,
+	"raid":            3,
+	"mirror":          4,
+	"multipath":       4,
+	"flakey":          4,
+	"integrity":       4,
+	"cache":           7,
+}
+
+// devicePositions tells what arguments of a target refer to the underlying devices
+var devicePositions = map[string][]int{
+	"linear":          {0},
+	"crypt":           {3},
+	"verity":          {1, 2},
+	"delay":           {0},
+	"snapshot":        {0, 1},
+	"snapshot-origin": {0},
+	"thin-pool":       {0, 1},
+	"flakey":          {0},
+	"integrity":       {0},
+	"cache":           {0, 1, 2},
+}
+
+// defaultStatus is a status reported by the targets unless it is changed with SetTargetStatus
+var defaultStatus = map[string]string{
+	"verity": "V",
+}
+
+// MessageHandler handles target messages sent with DM_TARGET_MSG. It returns the reply text or
+// unix.Errno if the message is rejected.
+type MessageHandler func(name string, sector uint64, message string) (string, error)
+
+type target struct {
+	start, length uint64 // in sectors
+	targetType    string
+	params        string
+}
+
+type table struct {
+	targets  []target
+	readOnly bool
+}
+
+type device struct {
+	name, uuid string
+	devno      uint64
+	live       *table
+	inactive   *table
+	suspended  bool
+	eventNr    uint32
+	openCount  int32          // number of external openers, see Open
+	status     map[int]string // target status overrides
+	deferred   bool           // the device is removed once it is not used anymore, see DM_DEFERRED_REMOVE
+}
+
+// Fake is an in-memory implementation of devmapper.Transport, devmapper.Keyring and devmapper.EventPoller with
+// kernel-like semantics and errnos. It supports device creation, removal, rename, table load/clear, suspend/resume,
+// status, deps, device list, info, target messages, event waiting and watching. Fake is safe for concurrent use.
+type Fake struct {
+	// Messages handles DM_TARGET_MSG, if nil then all messages are rejected with EINVAL
+	Messages MessageHandler
+
+	mu        sync.Mutex
+	events    *sync.Cond // broadcasted every time a device raises an event
+	devices   map[string]*device
+	nextMinor uint32
+	keys      map[string]int // in-memory keyring, key description to id
+	nextKeyID int
+	// globalEventNr counts device creation, removal, rename and target events, see devmapper.EventPoller
+	globalEventNr uint64
+}
+
+// New creates an empty fake device mapper
+func New() *Fake {
+	f := &Fake{devices: make(map[string]*device), keys: make(map[string]int)}
+	f.events = sync.NewCond(&f.mu)
+	return f
+}
+
+// Close implements devmapper.Transport. The fake keeps its state after closing.
+func (f *Fake) Close() error {
+	return nil
+}
+
+// AddKey implements devmapper.Keyring, the fake keeps the keys in memory instead of the process keyring.
+// The payload is not stored, the fake only checks that the keys referenced by verity tables exist.
+func (f *Fake) AddKey(desc string, payload []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if id, ok := f.keys[desc]; ok {
+		return id, nil // add_key updates the existing key
+	}
+	f.nextKeyID++
+	f.keys[desc] = f.nextKeyID
+	return f.nextKeyID, nil
+}
+
+// SearchKey implements devmapper.Keyring
+func (f *Fake) SearchKey(desc string) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	id, ok := f.keys[desc]
+	if !ok {
+		return 0, unix.ENOKEY
+	}
+	return id, nil
+}
+
+// UnlinkKey implements devmapper.Keyring
+func (f *Fake) UnlinkKey(id int) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for desc, other := range f.keys {
+		if other == id {
+			delete(f.keys, desc)
+			return nil
+		}
+	}
+	return unix.ENOKEY
+}
+
+// Open simulates an external opener of the device (e.g. a mounted filesystem), it increments the device open count
+func (f *Fake) Open(name string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	d, ok := f.devices[name]
+	if !ok {
+		return unix.ENXIO
+	}
+	d.openCount++
+	return nil
+}
+
+// Release decrements the device open count incremented by Open
+func (f *Fake) Release(name string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	d, ok := f.devices[name]
+	if !ok {
+		return unix.ENXIO
+	}
+	if d.openCount == 0 {
+		return unix.EINVAL
+	}
+	d.openCount--
+	f.removeDeferred()
+	return nil
+}
+
+// SetTargetStatus changes the status reported for the target with given index of the device live table
+// and raises a device event, e.g. SetTargetStatus("verity", 0, "C") simulates verity corruption.
+func (f *Fake) SetTargetStatus(name string, index int, status string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	d, ok := f.devices[name]
+	if !ok {
+		return unix.ENXIO
+	}
+	if d.live == nil || index < 0 || index >= len(d.live.targets) {
+		return unix.EINVAL
+	}
+	if d.status == nil {
+		d.status = make(map[int]string)
+	}
+	d.status[index] = status
+	f.raiseEvent(d)
+	return nil
+}
+
+// RaiseEvent simulates a device event raised by one of the device targets
+func (f *Fake) RaiseEvent(name string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	d, ok := f.devices[name]
+	if !ok {
+		return unix.ENXIO
+	}
+	f.raiseEvent(d)
+	return nil
+}
+
+func (f *Fake) raiseEvent(d *device) {
+	d.eventNr++
+	f.globalEvent()
+}
+
+// globalEvent wakes up the event waiters, the kernel does it on every device creation, removal and rename
+// as well as on target events
+func (f *Fake) globalEvent() {
+	f.globalEventNr++
+	f.events.Broadcast()
+}
+
+// GlobalEventNr implements devmapper.EventPoller
+func (f *Fake) GlobalEventNr() uint64 {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.globalEventNr
+}
+
+// WaitGlobalEvent implements devmapper.EventPoller
+func (f *Fake) WaitGlobalEvent(ctx context.Context, eventNr uint64) error {
+	stop := context.AfterFunc(ctx, func() {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		f.events.Broadcast()
+	})
+	defer stop()
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for f.globalEventNr == eventNr {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		f.events.Wait()
+	}
+	return nil
+}
+
+// Ioctl implements devmapper.Transport
+func (f *Fake) Ioctl(cmd uintptr, data []byte) error {
+	if len(data) < unix.SizeofDmIoctl {
+		return unix.EINVAL
+	}
+	hdr := (*unix.DmIoctl)(unsafe.Pointer(&data[0]))
+	if hdr.Version[0] != version[0] || hdr.Version[1] > version[1] {
+		hdr.Version = version
+		return unix.EINVAL
+	}
+	hdr.Version = version
+
+	paramSize := int(hdr.Data_size)
+	if paramSize < unix.SizeofDmIoctl || paramSize > len(data) || int(hdr.Data_start) > paramSize {
+		return unix.EINVAL
+	}
+	data = data[:paramSize]
+	in := data[hdr.Data_start:]
+
+	hdr.Flags &^= unix.DM_BUFFER_FULL_FLAG | unix.DM_UEVENT_GENERATED_FLAG | unix.DM_DATA_OUT_FLAG
+	hdr.Data_size = uint32(sizeofDmIoctlHeader)
+
+	if cmd == unix.DM_DEV_WAIT {
+		return f.devWait(hdr, data)
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	switch cmd {
+	case unix.DM_VERSION:
+		return nil
+	case unix.DM_REMOVE_ALL:
+		return f.removeAll()
+	case unix.DM_LIST_DEVICES:
+		return f.listDevices(hdr, data)
+	case unix.DM_DEV_CREATE:
+		return f.devCreate(hdr)
+	case unix.DM_DEV_REMOVE:
+		return f.devRemove(hdr)
+	case unix.DM_DEV_RENAME:
+		return f.devRename(hdr, in)
+	case unix.DM_DEV_SUSPEND:
+		return f.devSuspend(hdr)
+	case unix.DM_DEV_STATUS:
+		d, err := f.find(hdr)
+		if err != nil {
+			return err
+		}
+		f.devStatus(d, hdr)
+		return nil
+	case unix.DM_TABLE_LOAD:
+		return f.tableLoad(hdr, in)
+	case unix.DM_TABLE_CLEAR:
+		d, err := f.find(hdr)
+		if err != nil {
+			return err
+		}
+		d.inactive = nil
+		f.devStatus(d, hdr)
+		return nil
+	case unix.DM_TABLE_DEPS:
+		return f.tableDeps(hdr, data)
+	case unix.DM_TABLE_STATUS:
+		d, err := f.find(hdr)
+		if err != nil {
+			return err
+		}
+		return f.tableStatus(d, hdr, data)
+	case unix.DM_TARGET_MSG:
+		return f.targetMessage(hdr, in, data)
+	default:
+		return unix.ENOTTY
+	}
+}
+
+// find looks up a device the same way kernel does: by uuid, name or device number
+func (f *Fake) find(hdr *unix.DmIoctl) (*device, error) {
+	name := cString(hdr.Name[:])
+	uuid := cString(hdr.Uuid[:])
+
+	switch {
+	case uuid != "":
+		if name != "" || hdr.Dev != 0 {
+			return nil, unix.EINVAL
+		}
+		for _, d := range f.devices {
+			if d.uuid == uuid {
+				return d, nil
+			}
+		}
+	case name != "":
+		if d, ok := f.devices[name]; ok {
+			return d, nil
+		}
+	case hdr.Dev != 0:
+		for _, d := range f.devices {
+			if d.devno == hdr.Dev {
+				return d, nil
+			}
+		}
+	default:
+		return nil, unix.EINVAL
+	}
+	return nil, unix.ENXIO
+}
+
+// devStatus fills the header with the device status, the same as kernel's __dev_status()
+func (f *Fake) devStatus(d *device, hdr *unix.DmIoctl) {
+	hdr.Flags &^= unix.DM_SUSPEND_FLAG | unix.DM_READONLY_FLAG | unix.DM_ACTIVE_PRESENT_FLAG | unix.DM_INACTIVE_PRESENT_FLAG | unix.DM_DEFERRED_REMOVE
+	if d.suspended {
+		hdr.Flags |= unix.DM_SUSPEND_FLAG
+	}
+	if d.deferred {
+		hdr.Flags |= unix.DM_DEFERRED_REMOVE
+	}
+	hdr.Target_count = 0
+	if d.live != nil {
+		hdr.Flags |= unix.DM_ACTIVE_PRESENT_FLAG
+		hdr.Target_count = uint32(len(d.live.targets))
+		if d.live.readOnly {
+			hdr.Flags |= unix.DM_READONLY_FLAG
+		}
+	}
+	if d.inactive != nil {
+		hdr.Flags |= unix.DM_INACTIVE_PRESENT_FLAG
+	}
+
+	hdr.Dev = d.devno
+	hdr.Open_count = f.openCount(d)
+	hdr.Event_nr = d.eventNr
+	hdr.Name = [len(hdr.Name)]byte{}
+	copy(hdr.Name[:], d.name)
+	hdr.Uuid = [len(hdr.Uuid)]byte{}
+	copy(hdr.Uuid[:], d.uuid)
+}
+
+// openCount returns the number of external openers plus the number of tables that use the device
+func (f *Fake) openCount(d *device) int32 {
+	count := d.openCount
+	for _, other := range f.devices {
+		for _, t := range []*table{other.live, other.inactive} {
+			if t == nil {
+				continue
+			}
+			for _, dep := range f.tableDevices(t) {
+				if dep == d.devno {
+					count++
+					break
+				}
+			}
+		}
+	}
+	return count
+}
+
+func (f *Fake) removeAll() error {
+	for name, d := range f.devices {
+		if f.openCount(d) == 0 {
+			delete(f.devices, name)
+		}
+	}
+	f.globalEvent()
+	return nil
+}
+
+func (f *Fake) devCreate(hdr *unix.DmIoctl) error {
+	name := cString(hdr.Name[:])
+	uuid := cString(hdr.Uuid[:])
+	if name == "" || strings.Contains(name, "/") {
+		return unix.EINVAL
+	}
+	if _, ok := f.devices[name]; ok {
+		return unix.EBUSY
+	}
+	if uuid != "" {
+		for _, d := range f.devices {
+			if d.uuid == uuid {
+				return unix.EBUSY
+			}
+		}
+	}
+
+	d := &device{name: name, uuid: uuid, devno: unix.Mkdev(Major, f.nextMinor)}
+	f.nextMinor++
+	f.devices[name] = d
+	f.globalEvent()
+	f.devStatus(d, hdr)
+	return nil
+}
+
+func (f *Fake) devRemove(hdr *unix.DmIoctl) error {
+	d, err := f.find(hdr)
+	if err != nil {
+		return err
+	}
+	if f.openCount(d) > 0 {
+		if hdr.Flags&unix.DM_DEFERRED_REMOVE != 0 {
+			d.deferred = true // kernel reports success and keeps DM_DEFERRED_REMOVE flag in the output
+			return nil
+		}
+		return unix.EBUSY
+	}
+	delete(f.devices, d.name)
+	hdr.Flags &^= unix.DM_DEFERRED_REMOVE
+	hdr.Flags |= unix.DM_UEVENT_GENERATED_FLAG
+	f.globalEvent()    // wake up waiters of the removed device
+	f.removeDeferred() // the removed device might be the last user of a device with deferred removal
+	return nil
+}
+
+// removeDeferred removes devices with pending deferred removal that are not used anymore
+func (f *Fake) removeDeferred() {
+	for removed := true; removed; {
+		removed = false
+		for name, d := range f.devices {
+			if d.deferred && f.openCount(d) == 0 {
+				delete(f.devices, name)
+				removed = true
+			}
+		}
+	}
+	f.globalEvent()
+}
+
+func (f *Fake) devRename(hdr *unix.DmIoctl, in []byte) error {
+	if hdr.Data_start < uint32(sizeofDmIoctlHeader) || bytes.IndexByte(in, 0) == -1 {
+		return unix.EINVAL // the new name must be a NUL-terminated string
+	}
+	newValue := cString(in)
+	changeUUID := hdr.Flags&unix.DM_UUID_FLAG != 0
+	maxLen := unix.DM_NAME_LEN
+	if changeUUID {
+		maxLen = unix.DM_UUID_LEN
+	}
+	if newValue == "" || len(newValue) >= maxLen {
+		return unix.EINVAL
+	}
+
+	d, err := f.find(hdr)
+	if err != nil {
+		return err
+	}
+
+	if changeUUID {
+		if d.uuid != "" {
+			return unix.EINVAL // uuid can be set only once
+		}
+		for _, other := range f.devices {
+			if other.uuid == newValue {
+				return unix.EBUSY
+			}
+		}
+		d.uuid = newValue
+	} else {
+		if strings.Contains(newValue, "/") {
+			return unix.EINVAL
+		}
+		if _, ok := f.devices[newValue]; ok {
+			return unix.EBUSY
+		}
+		delete(f.devices, d.name)
+		d.name = newValue
+		f.devices[d.name] = d
+	}
+
+	// kernel wakes up event waiters on rename
+	if d.live != nil {
+		f.raiseEvent(d)
+	} else {
+		f.globalEvent()
+	}
+	hdr.Flags |= unix.DM_UEVENT_GENERATED_FLAG
+	f.devStatus(d, hdr)
+	return nil
+}
+
+func (f *Fake) devSuspend(hdr *unix.DmIoctl) error {
+	d, err := f.find(hdr)
+	if err != nil {
+		return err
+	}
+
+	if hdr.Flags&unix.DM_SUSPEND_FLAG != 0 {
+		d.suspended = true
+	} else {
+		if d.live == nil && d.inactive == nil {
+			return unix.EINVAL // kernel refuses to resume a device without a table
+		}
+		if d.inactive != nil {
+			d.live = d.inactive
+			d.inactive = nil
+			d.status = nil
+		}
+		d.suspended = false
+		hdr.Flags |= unix.DM_UEVENT_GENERATED_FLAG
+	}
+	f.devStatus(d, hdr)
+	return nil
+}
+
+func (f *Fake) tableLoad(hdr *unix.DmIoctl, in []byte) error {
+	d, err := f.find(hdr)
+	if err != nil {
+		return err
+	}
+	if hdr.Target_count == 0 {
+		return unix.EINVAL
+	}
+
+	t := &table{readOnly: hdr.Flags&unix.DM_READONLY_FLAG != 0}
+	var offset uint32 // for DM_TABLE_LOAD spec.next is relative to the current spec
+	var next uint64   // the next target must start where the previous one ended
+	for i := uint32(0); i < hdr.Target_count; i++ {
+		if int(offset)+unix.SizeofDmTargetSpec > len(in) {
+			return unix.EINVAL
+		}
+		spec := (*unix.DmTargetSpec)(unsafe.Pointer(&in[offset]))
+		paramsData := in[int(offset)+unix.SizeofDmTargetSpec:]
+		if bytes.IndexByte(paramsData, 0) == -1 {
+			return unix.EINVAL
+		}
+		tgt := target{
+			start:      spec.Sector_start,
+			length:     spec.Length,
+			targetType: cString(spec.Target_type[:]),
+			params:     strings.Join(strings.Fields(cString(paramsData)), " "),
+		}
+		if tgt.start != next || tgt.length == 0 {
+			return unix.EINVAL // gap in the table or zero-length target
+		}
+		next = tgt.start + tgt.length
+
+		minArgs, ok := knownTargets[tgt.targetType]
+		if !ok || len(strings.Fields(tgt.params)) < minArgs {
+			return unix.EINVAL
+		}
+		if err := f.checkRootHashSigKey(tgt); err != nil {
+			return err
+		}
+		t.targets = append(t.targets, tgt)
+		offset += spec.Next
+	}
+
+	d.inactive = t
+	f.devStatus(d, hdr)
+	return nil
+}
+
+// checkRootHashSigKey checks that the root hash signature key referenced by a verity target exists,
+// the kernel reads the key when the target is created
+func (f *Fake) checkRootHashSigKey(tgt target) error {
+	if tgt.targetType != "verity" {
+		return nil
+	}
+	args := strings.Fields(tgt.params)
+	for i := 10; i < len(args)-1; i++ {
+		if args[i] == "root_hash_sig_key_desc" {
+			if _, ok := f.keys[args[i+1]]; !ok {
+				return unix.ENOKEY
+			}
+		}
+	}
+	return nil
+}
+
+// tableDevices returns numbers of the devices used by the table
+func (f *Fake) tableDevices(t *table) []uint64 {
+	var deps []uint64
+	seen := make(map[uint64]bool)
+	for _, tgt := range t.targets {
+		args := strings.Fields(tgt.params)
+		for _, pos := range devicePositionsOf(tgt.targetType, args) {
+			if pos >= len(args) {
+				continue
+			}
+			devno, ok := f.resolveDevice(args[pos])
+			if ok && !seen[devno] {
+				seen[devno] = true
+				deps = append(deps, devno)
+			}
+		}
+	}
+	return deps
+}
+
+func devicePositionsOf(targetType string, args []string) []int {
+	if targetType == "striped" {
+		// <num stripes> <chunk size> [<dev path> <offset>]+
+		var positions []int
+		for i := 2; i < len(args); i += 2 {
+			positions = append(positions, i)
+		}
+		return positions
+	}
+	positions := devicePositions[targetType]
+	if targetType == "verity" {
+		// the optional FEC device follows 'use_fec_from_device'
+		for i := 10; i < len(args)-1; i++ {
+			if args[i] == "use_fec_from_device" {
+				positions = append(slices.Clone(positions), i+1)
+			}
+		}
+	}
+	return positions
+}
+
+var devnoRe = regexp.MustCompile(`^(\d+):(\d+)$`)
+
+// resolveDevice converts a device reference used in a table into the device number.
+// The kernel accepts both "major:minor" and a device path.
+func (f *Fake) resolveDevice(s string) (uint64, bool) {
+	if m := devnoRe.FindStringSubmatch(s); m != nil {
+		major, _ := strconv.ParseUint(m[1], 10, 32)
+		minor, _ := strconv.ParseUint(m[2], 10, 32)
+		return unix.Mkdev(uint32(major), uint32(minor)), true
+	}
+	if name, ok := strings.CutPrefix(s, "/dev/mapper/"); ok {
+		if d, ok := f.devices[name]; ok {
+			return d.devno, true
+		}
+	}
+	if minor, ok := strings.CutPrefix(s, "/dev/dm-"); ok {
+		if n, err := strconv.ParseUint(minor, 10, 32); err == nil {
+			return unix.Mkdev(Major, uint32(n)), true
+		}
+	}
+	var st unix.Stat_t
+	if err := unix.Stat(s, &st); err == nil && st.Mode&unix.S_IFMT == unix.S_IFBLK {
+		return uint64(st.Rdev), true
+	}
+	return 0, false
+}
+
+// writeOutput copies the command output into the buffer the same way kernel does, setting
+// DM_BUFFER_FULL_FLAG if the buffer is too small
+func writeOutput(hdr *unix.DmIoctl, data []byte, out []byte) bool {
+	hdr.Data_start = outputStart
+	if outputStart+len(out) > len(data) {
+		hdr.Flags |= unix.DM_BUFFER_FULL_FLAG
+		return false
+	}
+	copy(data[outputStart:], out)
+	hdr.Data_size = uint32(outputStart + len(out))
+	return true
+}
+
+func (f *Fake) tableDeps(hdr *unix.DmIoctl, data []byte) error {
+	d, err := f.find(hdr)
+	if err != nil {
+		return err
+	}
+	f.devStatus(d, hdr)
+	if d.live == nil {
+		return nil
+	}
+
+	deps := f.tableDevices(d.live)
+	out := make([]byte, 8+8*len(deps)) // struct dm_target_deps
+	*(*uint32)(unsafe.Pointer(&out[0])) = uint32(len(deps))
+	for i, dep := range deps {
+		*(*uint64)(unsafe.Pointer(&out[8+8*i])) = dep
+	}
+	writeOutput(hdr, data, out)
+	return nil
+}
+
+func (f *Fake) tableStatus(d *device, hdr *unix.DmIoctl, data []byte) error {
+	f.devStatus(d, hdr)
+
+	t := d.live
+	if hdr.Flags&unix.DM_QUERY_INACTIVE_TABLE_FLAG != 0 {
+		t = d.inactive
+	}
+	if t == nil {
+		hdr.Target_count = 0
+		return nil
+	}
+
+	var out []byte
+	for i, tgt := range t.targets {
+		var str string
+		if hdr.Flags&unix.DM_STATUS_TABLE_FLAG != 0 {
+			str = f.normalizeParams(tgt)
+		} else if s, ok := d.status[i]; ok && t == d.live {
+			str = s
+		} else {
+			str = defaultStatus[tgt.targetType]
+		}
+
+		specOffset := len(out)
+		out = append(out, make([]byte, unix.SizeofDmTargetSpec)...)
+		out = append(out, str...)
+		out = append(out, 0)
+		out = append(out, make([]byte, roundUp(len(out), alignment)-len(out))...)
+
+		spec := (*unix.DmTargetSpec)(unsafe.Pointer(&out[specOffset]))
+		spec.Sector_start = tgt.start
+		spec.Length = tgt.length
+		spec.Next = uint32(len(out)) // for DM_TABLE_STATUS spec.next is relative to the beginning of the output
+		copy(spec.Target_type[:], tgt.targetType)
+	}
+	hdr.Target_count = uint32(len(t.targets))
+	writeOutput(hdr, data, out)
+	return nil
+}
+
+// normalizeParams returns the table params the way kernel reports them, with devices in "major:minor" format
+func (f *Fake) normalizeParams(tgt target) string {
+	args := strings.Fields(tgt.params)
+	for _, pos := range devicePositionsOf(tgt.targetType, args) {
+		if pos >= len(args) {
+			continue
+		}
+		if devno, ok := f.resolveDevice(args[pos]); ok {
+			args[pos] = fmt.Sprintf("%d:%d", unix.Major(devno), unix.Minor(devno))
+		}
+	}
+	return strings.Join(args, " ")
+}
+
+func (f *Fake) listDevices(hdr *unix.DmIoctl, data []byte) error {
+	names := make([]string, 0, len(f.devices))
+	for name := range f.devices {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	withUUID := hdr.Flags&unix.DM_UUID_FLAG != 0
+	out := make([]byte, 16) // empty struct dm_name_list, dev == 0 means no devices
+	if len(names) != 0 {
+		out = out[:0]
+	}
+	for i, name := range names {
+		d := f.devices[name]
+		itemStart := len(out)
+		out = append(out, make([]byte, 12)...)
+		*(*uint64)(unsafe.Pointer(&out[itemStart])) = d.devno
+		out = append(out, name...)
+		out = append(out, 0)
+		out = append(out, make([]byte, roundUp(len(out), alignment)-len(out))...)
+
+		var flags uint32
+		if withUUID {
+			flags = unix.DM_NAME_LIST_FLAG_DOESNT_HAVE_UUID
+			if d.uuid != "" {
+				flags = unix.DM_NAME_LIST_FLAG_HAS_UUID
+			}
+		}
+		eventStart := len(out)
+		out = append(out, make([]byte, 8)...)
+		*(*uint32)(unsafe.Pointer(&out[eventStart])) = d.eventNr
+		*(*uint32)(unsafe.Pointer(&out[eventStart+4])) = flags
+		if flags&unix.DM_NAME_LIST_FLAG_HAS_UUID != 0 {
+			out = append(out, d.uuid...)
+			out = append(out, 0)
+			out = append(out, make([]byte, roundUp(len(out), alignment)-len(out))...)
+		}
+
+		if i != len(names)-1 {
+			*(*uint32)(unsafe.Pointer(&out[itemStart+8])) = uint32(len(out) - itemStart)
+		}
+	}
+	writeOutput(hdr, data, out)
+	return nil
+}
+
+func (f *Fake) targetMessage(hdr *unix.DmIoctl, in []byte, data []byte) error {
+	d, err := f.find(hdr)
+	if err != nil {
+		return err
+	}
+	f.devStatus(d, hdr)
+
+	const sizeofDmTargetMsg = int(unsafe.Sizeof(unix.DmTargetMsg{}))
+	if len(in) < sizeofDmTargetMsg || bytes.IndexByte(in[sizeofDmTargetMsg:], 0) == -1 {
+		return unix.EINVAL
+	}
+	sector := (*unix.DmTargetMsg)(unsafe.Pointer(&in[0])).Sector
+	message := cString(in[sizeofDmTargetMsg:])
+	if message == "@cancel_deferred_remove" {
+		// messages starting with '@' are handled by device mapper core, they do not need a table
+		d.deferred = false
+		return nil
+	}
+	if message == "" || d.live == nil {
+		return unix.EINVAL
+	}
+	last := d.live.targets[len(d.live.targets)-1]
+	if sector >= last.start+last.length {
+		return unix.EINVAL // message sector is outside of the device
+	}
+	if f.Messages == nil {
+		return unix.EINVAL
+	}
+
+	reply, err := f.Messages(d.name, sector, message)
+	if err != nil {
+		return err
+	}
+	if reply != "" {
+		hdr.Flags |= unix.DM_DATA_OUT_FLAG
+		writeOutput(hdr, data, append([]byte(reply), 0))
+	}
+	return nil
+}
+
+// devWait blocks until the device event counter differs from the one passed in the header
+func (f *Fake) devWait(hdr *unix.DmIoctl, data []byte) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	d, err := f.find(hdr)
+	if err != nil {
+		return err
+	}
+	for d.eventNr == hdr.Event_nr {
+		f.events.Wait()
+		if f.devices[d.name] != d {
+			return unix.ENXIO // the device has been removed while waiting
+		}
+	}
+	return f.tableStatus(d, hdr, data)
+}
+
+func cString(buff []byte) string {
+	idx := bytes.IndexByte(buff, 0)
+	if idx != -1 {
+		buff = buff[:idx]
+	}
+	return string(buff)
+}
+
+func roundUp(n int, divider int) int {
+	return (n + divider - 1) / divider * divider
+}
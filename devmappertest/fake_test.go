@@ -0,0 +1,489 @@
+package devmappertest
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/anatol/devmapper.go"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sys/unix"
+)
+
+func newClient(t *testing.T) (*Fake, *devmapper.Client) {
+	fake := New()
+	c := devmapper.NewClientWithTransport(fake)
+	t.Cleanup(func() { _ = c.Close() })
+	return fake, c
+}
+
+func TestFakeLifecycle(t *testing.T) {
+	t.Parallel()
+	_, c := newClient(t)
+
+	major, minor, _, err := c.GetVersion()
+	require.NoError(t, err)
+	require.Equal(t, uint32(4), major)
+	require.Equal(t, uint32(48), minor)
+
+	list, err := c.List()
+	require.NoError(t, err)
+	require.Empty(t, list)
+
+	require.NoError(t, c.Create("test", "uuid-1"))
+	require.ErrorIs(t, c.Create("test", ""), devmapper.ErrExists)
+	require.ErrorIs(t, c.Create("other", "uuid-1"), devmapper.ErrExists)
+
+	info, err := c.InfoByName("test")
+	require.NoError(t, err)
+	require.Equal(t, "uuid-1", info.UUID)
+	require.Equal(t, uint32(0), info.TargetsNum)
+	require.Zero(t, info.Flags&unix.DM_ACTIVE_PRESENT_FLAG)
+	require.ErrorIs(t, c.Resume("test"), unix.EINVAL, "device has no table to resume")
+
+	tables := []devmapper.Table{
+		devmapper.ZeroTable{Start: 0, Length: 4096},
+		devmapper.RawTable{Start: 4096, Length: 4096, Type: "error"},
+	}
+	require.NoError(t, c.Load("test", 0, tables...))
+	info, err = c.InfoByName("test")
+	require.NoError(t, err)
+	require.NotZero(t, info.Flags&unix.DM_INACTIVE_PRESENT_FLAG)
+
+	inactive, err := c.Tables("test", true)
+	require.NoError(t, err)
+	require.Equal(t, tables, inactive)
+
+	require.NoError(t, c.Resume("test"))
+	info, err = c.InfoByName("test")
+	require.NoError(t, err)
+	require.Equal(t, uint32(2), info.TargetsNum)
+	require.NotZero(t, info.Flags&unix.DM_ACTIVE_PRESENT_FLAG)
+	require.Zero(t, info.Flags&unix.DM_INACTIVE_PRESENT_FLAG)
+
+	live, err := c.Tables("test", false)
+	require.NoError(t, err)
+	require.Equal(t, tables, live)
+
+	require.NoError(t, c.Suspend("test"))
+	info, err = c.InfoByName("test")
+	require.NoError(t, err)
+	require.NotZero(t, info.Flags&unix.DM_SUSPEND_FLAG)
+	require.NoError(t, c.Resume("test"))
+
+	byUUID, err := c.InfoByUUID("uuid-1")
+	require.NoError(t, err)
+	require.Equal(t, info.DevNo, byUUID.DevNo)
+	byDevno, err := c.InfoByDevno(info.DevNo)
+	require.NoError(t, err)
+	require.Equal(t, "test", byDevno.Name)
+
+	require.NoError(t, c.Rename("test", "renamed"))
+	_, err = c.InfoByName("test")
+	require.ErrorIs(t, err, devmapper.ErrNotFound)
+
+	list, err = c.List()
+	require.NoError(t, err)
+	require.Len(t, list, 1)
+	require.Equal(t, "renamed", list[0].Name)
+	require.Equal(t, "uuid-1", list[0].UUID)
+	require.Equal(t, uint32(1), list[0].EventNr, "rename raises an event")
+
+	require.NoError(t, c.Remove("renamed"))
+	require.ErrorIs(t, c.Remove("renamed"), devmapper.ErrNotFound)
+}
+
+func TestFakeLoadInvalidTable(t *testing.T) {
+	t.Parallel()
+	_, c := newClient(t)
+
+	require.NoError(t, c.Create("test", ""))
+	require.ErrorIs(t, c.Load("test", 0), devmapper.ErrInvalidTable, "no targets")
+	require.ErrorIs(t, c.Load("test", 0, devmapper.ZeroTable{Start: 512, Length: 4096}), devmapper.ErrInvalidTable, "gap at the beginning")
+	require.ErrorIs(t, c.Load("test", 0, devmapper.RawTable{Length: 4096, Type: "unknown"}), devmapper.ErrInvalidTable)
+	err := c.Load("test", 0, devmapper.RawTable{Length: 4096, Type: "linear", Params: "/dev/loop0"})
+	require.ErrorIs(t, err, devmapper.ErrInvalidTable, "not enough params")
+	require.EqualError(t, err, "dm ioctl DM_TABLE_LOAD test: invalid argument")
+	require.ErrorIs(t, c.Load("nonexistent", 0, devmapper.ZeroTable{Length: 4096}), devmapper.ErrNotFound)
+}
+
+func TestFakeStackedDevices(t *testing.T) {
+	t.Parallel()
+	fake, c := newClient(t)
+
+	require.NoError(t, c.CreateAndLoad("lower", "", 0, devmapper.ZeroTable{Length: 8192}))
+	lower, err := c.InfoByName("lower")
+	require.NoError(t, err)
+
+	require.NoError(t, c.CreateAndLoad("upper", "", 0, devmapper.LinearTable{
+		Length:        8192,
+		BackendDevice: "/dev/mapper/lower",
+	}))
+
+	deps, err := c.Deps("upper")
+	require.NoError(t, err)
+	require.Equal(t, []uint64{lower.DevNo}, deps)
+
+	require.NoError(t, c.Create("empty", ""))
+	deps, err = c.Deps("empty")
+	require.NoError(t, err, "device without a table has no dependencies")
+	require.Empty(t, deps)
+	require.NoError(t, c.Remove("empty"))
+
+	live, err := c.Tables("upper", false)
+	require.NoError(t, err)
+	require.Len(t, live, 1)
+	require.Equal(t, fmt.Sprintf("%d:%d", unix.Major(lower.DevNo), unix.Minor(lower.DevNo)), live[0].(devmapper.LinearTable).BackendDevice)
+
+	lower, err = c.InfoByName("lower")
+	require.NoError(t, err)
+	require.Equal(t, int32(1), lower.OpenCount)
+	require.ErrorIs(t, c.Remove("lower"), devmapper.ErrBusy)
+
+	require.NoError(t, fake.Open("upper"))
+	_, err = c.RemoveTree("upper", devmapper.RemoveTreeOptions{DryRun: true})
+	require.ErrorIs(t, err, devmapper.ErrBusy, "dry run reports that upper is held open")
+	_, err = c.RemoveTree("upper", devmapper.RemoveTreeOptions{})
+	require.ErrorIs(t, err, devmapper.ErrBusy, "upper is held open")
+	require.NoError(t, fake.Release("upper"))
+
+	dryRun, err := c.RemoveTree("upper", devmapper.RemoveTreeOptions{DryRun: true})
+	require.NoError(t, err)
+	require.Equal(t, []string{"upper", "lower"}, dryRun)
+
+	removed, err := c.RemoveTree("upper", devmapper.RemoveTreeOptions{})
+	require.NoError(t, err)
+	require.Equal(t, []string{"upper", "lower"}, removed)
+}
+
+// removingTransport removes a device right before the first DM_DEV_STATUS, as if another process did it
+type removingTransport struct {
+	*Fake
+	remove string
+	once   sync.Once
+}
+
+func (r *removingTransport) Ioctl(cmd uintptr, data []byte) error {
+	if cmd == unix.DM_DEV_STATUS {
+		r.once.Do(func() {
+			_ = devmapper.NewClientWithTransport(r.Fake).Remove(r.remove)
+		})
+	}
+	return r.Fake.Ioctl(cmd, data)
+}
+
+func TestFakeTopologyRemovedDevice(t *testing.T) {
+	t.Parallel()
+	fake := New()
+	c := devmapper.NewClientWithTransport(&removingTransport{Fake: fake, remove: "removed"})
+	defer c.Close()
+
+	require.NoError(t, c.CreateAndLoad("kept", "", 0, devmapper.ZeroTable{Length: 4096}))
+	require.NoError(t, c.CreateAndLoad("removed", "", 0, devmapper.ZeroTable{Length: 4096}))
+
+	g, err := c.Topology()
+	require.NoError(t, err, "a device removed concurrently is skipped")
+	require.Len(t, g.Nodes, 1)
+	for _, n := range g.Nodes {
+		require.Equal(t, "kept", n.Name)
+	}
+}
+
+func TestFakeStatusAndEvents(t *testing.T) {
+	t.Parallel()
+	fake, c := newClient(t)
+
+	require.NoError(t, c.CreateAndLoad("test", "", 0, devmapper.ZeroTable{Length: 4096}))
+	info, err := c.InfoByName("test")
+	require.NoError(t, err)
+
+	status, err := c.Status("test")
+	require.NoError(t, err)
+	require.Equal(t, []devmapper.TargetStatus{{Length: 4096, Type: "zero"}}, status)
+
+	done := make(chan uint32)
+	go func() {
+		eventNr, status, err := c.WaitEvent("test", info.EventNr)
+		if err == nil && len(status) == 1 && status[0].Status == "custom" {
+			done <- eventNr
+		}
+		close(done)
+	}()
+
+	time.Sleep(10 * time.Millisecond)
+	require.NoError(t, fake.SetTargetStatus("test", 0, "custom"))
+	require.Equal(t, info.EventNr+1, <-done)
+
+	status, err = c.Status("test")
+	require.NoError(t, err)
+	require.Equal(t, "custom", status[0].Status)
+}
+
+func TestFakeWatch(t *testing.T) {
+	t.Parallel()
+	fake, c := newClient(t)
+
+	require.NoError(t, c.CreateAndLoad("test", "", 0, devmapper.ZeroTable{Length: 4096}))
+	require.NoError(t, c.CreateAndLoad("other", "", 0, devmapper.ZeroTable{Length: 4096}))
+	old, err := c.InfoByName("test")
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	w, err := c.Watch(ctx)
+	require.NoError(t, err)
+
+	// the watcher blocks on sending the event of the other device, so it sees the re-created device at once
+	require.NoError(t, fake.RaiseEvent("other"))
+	require.NoError(t, c.Remove("test"))
+	require.NoError(t, c.CreateAndLoad("test", "", 0, devmapper.ZeroTable{Length: 4096}))
+	recreated, err := c.InfoByName("test")
+	require.NoError(t, err)
+	require.NotEqual(t, old.DevNo, recreated.DevNo)
+
+	var seen []devmapper.Event
+	for ev := range w.Events {
+		if ev.Name == "test" {
+			seen = append(seen, devmapper.Event{Type: ev.Type, Name: ev.Name, DevNo: ev.DevNo})
+		}
+		if len(seen) == 2 {
+			break
+		}
+	}
+	require.Equal(t, []devmapper.Event{
+		{Type: devmapper.EventRemoved, Name: "test", DevNo: old.DevNo},
+		{Type: devmapper.EventAdded, Name: "test", DevNo: recreated.DevNo},
+	}, seen)
+
+	cancel()
+	for range w.Events {
+		// drain the channel until the watcher stops
+	}
+	require.NoError(t, w.Err())
+}
+
+func TestFakeMessage(t *testing.T) {
+	t.Parallel()
+	fake, c := newClient(t)
+
+	require.NoError(t, c.CreateAndLoad("test", "", 0, devmapper.ZeroTable{Length: 4096}))
+
+	_, err := c.Message("test", 0, "hello")
+	require.ErrorIs(t, err, unix.EINVAL, "messages are rejected without a handler")
+
+	fake.Messages = func(name string, sector uint64, message string) (string, error) {
+		switch message {
+		case "hello":
+			return "world", nil
+		case "silent":
+			return "", nil
+		}
+		return "", unix.EINVAL
+	}
+	reply, err := c.Message("test", 0, "hello")
+	require.NoError(t, err)
+	require.Equal(t, "world", reply)
+
+	reply, err = c.Message("test", 0, "silent")
+	require.NoError(t, err)
+	require.Empty(t, reply)
+
+	_, err = c.Message("test", 8, "hello")
+	require.ErrorIs(t, err, unix.EINVAL, "the sector is outside of the device")
+}
+
+func TestFakeRemoveWithOptions(t *testing.T) {
+	t.Parallel()
+	fake, c := newClient(t)
+
+	require.NoError(t, c.CreateAndLoad("test", "", 0, devmapper.ZeroTable{Length: 4096}))
+	require.NoError(t, fake.Open("test"))
+
+	opts := devmapper.RemoveOptions{Retries: 2, RetryDelay: time.Millisecond}
+	require.ErrorIs(t, c.RemoveWithOptions("test", opts), devmapper.ErrBusy)
+
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		_ = fake.Release("test")
+	}()
+	opts = devmapper.RemoveOptions{Retries: 10, RetryDelay: 5 * time.Millisecond}
+	require.NoError(t, c.RemoveWithOptions("test", opts))
+	_, err := c.InfoByName("test")
+	require.ErrorIs(t, err, devmapper.ErrNotFound)
+}
+
+func TestFakeDeferredRemove(t *testing.T) {
+	t.Parallel()
+	fake, c := newClient(t)
+
+	require.NoError(t, c.CreateAndLoad("test", "", 0, devmapper.ZeroTable{Length: 4096}))
+	require.NoError(t, fake.Open("test"))
+
+	require.NoError(t, c.RemoveWithOptions("test", devmapper.RemoveOptions{Deferred: true}))
+	info, err := c.InfoByName("test")
+	require.NoError(t, err)
+	require.NotZero(t, info.Flags&unix.DM_DEFERRED_REMOVE)
+
+	require.NoError(t, c.CancelDeferredRemove("test"))
+	info, err = c.InfoByName("test")
+	require.NoError(t, err)
+	require.Zero(t, info.Flags&unix.DM_DEFERRED_REMOVE)
+
+	require.NoError(t, c.RemoveWithOptions("test", devmapper.RemoveOptions{Deferred: true}))
+	require.NoError(t, fake.Release("test"))
+	_, err = c.InfoByName("test")
+	require.ErrorIs(t, err, devmapper.ErrNotFound, "the device is removed on last close")
+}
+
+func TestFakeReload(t *testing.T) {
+	t.Parallel()
+	_, c := newClient(t)
+
+	require.NoError(t, c.CreateAndLoad("test", "", 0, devmapper.ZeroTable{Length: 4096}))
+
+	grown := devmapper.ZeroTable{Length: 8192}
+	require.NoError(t, c.Reload("test", devmapper.ReloadOptions{NoFlush: true}, grown))
+	live, err := c.Tables("test", false)
+	require.NoError(t, err)
+	require.Equal(t, []devmapper.Table{grown}, live)
+
+	err = c.Reload("test", devmapper.ReloadOptions{}, devmapper.RawTable{Length: 4096, Type: "unknown"})
+	require.ErrorIs(t, err, devmapper.ErrInvalidTable)
+	info, err := c.InfoByName("test")
+	require.NoError(t, err)
+	require.Zero(t, info.Flags&(unix.DM_SUSPEND_FLAG|unix.DM_INACTIVE_PRESENT_FLAG))
+	live, err = c.Tables("test", false)
+	require.NoError(t, err)
+	require.Equal(t, []devmapper.Table{grown}, live, "the old table is kept")
+
+	require.ErrorIs(t, c.Reload("nonexistent", devmapper.ReloadOptions{}, grown), devmapper.ErrNotFound)
+
+	// a device suspended by the caller stays suspended, the new table is swapped in on resume
+	require.NoError(t, c.Suspend("test"))
+	shrunk := devmapper.ZeroTable{Length: 2048}
+	require.NoError(t, c.Reload("test", devmapper.ReloadOptions{}, shrunk))
+	info, err = c.InfoByName("test")
+	require.NoError(t, err)
+	require.NotZero(t, info.Flags&unix.DM_SUSPEND_FLAG)
+	require.NotZero(t, info.Flags&unix.DM_INACTIVE_PRESENT_FLAG)
+	live, err = c.Tables("test", false)
+	require.NoError(t, err)
+	require.Equal(t, []devmapper.Table{grown}, live)
+
+	require.NoError(t, c.Resume("test"))
+	live, err = c.Tables("test", false)
+	require.NoError(t, err)
+	require.Equal(t, []devmapper.Table{shrunk}, live)
+}
+
+func TestFakeSuspendWithOptions(t *testing.T) {
+	t.Parallel()
+	_, c := newClient(t)
+
+	require.NoError(t, c.CreateAndLoad("test", "", 0, devmapper.ZeroTable{Length: 4096}))
+
+	suspended, err := c.SuspendWithOptions("test", devmapper.SuspendOptions{NoFlush: true, SkipLockfs: true})
+	require.NoError(t, err)
+	require.True(t, suspended)
+
+	suspended, err = c.SuspendWithOptions("test", devmapper.SuspendOptions{})
+	require.NoError(t, err)
+	require.True(t, suspended, "suspending a suspended device is a no-op")
+
+	require.NoError(t, c.Resume("test"))
+	info, err := c.InfoByName("test")
+	require.NoError(t, err)
+	require.Zero(t, info.Flags&unix.DM_SUSPEND_FLAG)
+
+	_, err = c.SuspendWithOptions("nonexistent", devmapper.SuspendOptions{})
+	require.ErrorIs(t, err, devmapper.ErrNotFound)
+}
+
+func TestFakeOpenUserspaceVolumeByName(t *testing.T) {
+	t.Parallel()
+	_, c := newClient(t)
+
+	backing := filepath.Join(t.TempDir(), "backing")
+	content := bytes.Repeat([]byte("0123456789abcdef"), 256) // 4096 bytes
+	require.NoError(t, os.WriteFile(backing, content, 0o600))
+
+	require.NoError(t, c.CreateAndLoad("test", "", 0,
+		devmapper.LinearTable{Length: 2048, BackendDevice: backing, BackendOffset: 1024},
+		devmapper.ZeroTable{Start: 2048, Length: 2048},
+	))
+
+	vol, err := c.OpenUserspaceVolumeByName("test", os.O_RDONLY, 0)
+	require.NoError(t, err)
+	defer vol.Close()
+
+	buf := make([]byte, 4096)
+	n, err := vol.ReadAt(buf, 0)
+	require.NoError(t, err)
+	require.Equal(t, 4096, n)
+	require.Equal(t, content[1024:3072], buf[:2048])
+	require.Equal(t, make([]byte, 2048), buf[2048:])
+
+	_, err = c.OpenVolume("test", os.O_RDONLY, 0)
+	require.Error(t, err, "the fake does not create device nodes")
+	require.NoError(t, c.CreateAndLoad("readonly", "", devmapper.ReadOnlyFlag, devmapper.ZeroTable{Length: 4096}))
+	_, err = c.OpenVolume("readonly", os.O_RDWR, 0)
+	require.ErrorContains(t, err, "is read-only")
+
+	require.NoError(t, c.Create("empty", ""))
+	_, err = c.OpenUserspaceVolumeByName("empty", os.O_RDONLY, 0)
+	require.ErrorContains(t, err, "has no live table")
+}
+
+func TestFakeVerityRootHashSig(t *testing.T) {
+	t.Parallel()
+	fake, c := newClient(t)
+
+	v := devmapper.VerityTable{
+		Length:         4096,
+		HashType:       1,
+		DataDevice:     "7:0",
+		HashDevice:     "7:1",
+		DataBlockSize:  4096,
+		HashBlockSize:  4096,
+		NumDataBlocks:  1,
+		HashStartBlock: 0,
+		Algorithm:      "sha256",
+		Digest:         "4392712ba01368efdf14b05c76f9e4df0d53664630b5d48632ed17a137f39076",
+		Salt:           "-",
+		RootHashSig:    []byte("pkcs7 signature"),
+	}
+	require.NoError(t, c.CreateAndLoad("test.sig", "", devmapper.ReadOnlyFlag, v))
+
+	_, err := fake.SearchKey("devmapper:verity:test.sig:0")
+	require.ErrorIs(t, err, unix.ENOKEY, "the key is unlinked once the table is loaded")
+
+	// the unlinked key is not reported, so the table read back can be loaded again
+	tables, err := c.Tables("test.sig", false)
+	require.NoError(t, err)
+	require.Len(t, tables, 1)
+	require.Empty(t, tables[0].(devmapper.VerityTable).RootHashSigKeyDesc)
+	require.NoError(t, c.Reload("test.sig", devmapper.ReloadOptions{Flags: devmapper.ReadOnlyFlag}, tables...))
+
+	// a key that exists already is neither replaced nor unlinked
+	v.RootHashSigKeyDesc = "custom"
+	id, err := fake.AddKey("custom", []byte("existing signature"))
+	require.NoError(t, err)
+	require.ErrorContains(t, c.Load("test.sig", devmapper.ReadOnlyFlag, v), "already exists")
+	v.RootHashSig = nil
+	require.NoError(t, c.Load("test.sig", devmapper.ReadOnlyFlag, v))
+	found, err := fake.SearchKey("custom")
+	require.NoError(t, err)
+	require.Equal(t, id, found)
+	tables, err = c.Tables("test.sig", true)
+	require.NoError(t, err)
+	require.Equal(t, "custom", tables[0].(devmapper.VerityTable).RootHashSigKeyDesc)
+
+	require.NoError(t, fake.UnlinkKey(id))
+	require.ErrorIs(t, c.Load("test.sig", devmapper.ReadOnlyFlag, v), unix.ENOKEY)
+	require.NoError(t, c.Remove("test.sig"))
+}
@@ -0,0 +1,105 @@
+package devmapper
+
+import (
+	"errors"
+	"fmt"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+var (
+	// ErrNotFound is returned when the device does not exist
+	ErrNotFound = errors.New("device does not exist")
+	// ErrBusy is returned when the device is in use, e.g. it is opened or held by another device mapper device
+	ErrBusy = errors.New("device is busy")
+	// ErrExists is returned when a device with the same name or uuid already exists
+	ErrExists = errors.New("device already exists")
+	// ErrInvalidTable is returned when the kernel rejects the table, e.g. because of an unknown target
+	// type, invalid target parameters or a gap between targets. The kernel log contains the details.
+	ErrInvalidTable = errors.New("invalid table")
+	// ErrUUIDAlreadySet is returned by SetUUID if the device already has a UUID. Kernel allows to set the UUID only once.
+	ErrUUIDAlreadySet = errors.New("device uuid is already set")
+)
+
+// Error is returned when a device mapper ioctl fails. It matches the errno returned by the kernel
+// as well as the ErrNotFound, ErrBusy, ErrExists and ErrInvalidTable errors, so it can be checked
+// with errors.Is(err, devmapper.ErrNotFound) or errors.Is(err, unix.ENXIO).
+type Error struct {
+	Cmd    string // ioctl command name, e.g. "DM_DEV_REMOVE"
+	Device string // device name, uuid or "major:minor", empty for commands that do not refer to a device
+	Err    error  // syscall.Errno returned by the kernel
+}
+
+func (e *Error) Error() string {
+	if e.Device == "" {
+		return fmt.Sprintf("dm ioctl %s: %v", e.Cmd, e.Err)
+	}
+	return fmt.Sprintf("dm ioctl %s %s: %v", e.Cmd, e.Device, e.Err)
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// Is maps the kernel errno to one of the sentinel errors
+func (e *Error) Is(target error) bool {
+	switch target {
+	case ErrNotFound:
+		return e.Err == unix.ENXIO
+	case ErrExists:
+		// kernel returns EBUSY if a device with the same name or uuid already exists
+		return e.Err == unix.EEXIST || (e.Err == unix.EBUSY && (e.Cmd == "DM_DEV_CREATE" || e.Cmd == "DM_DEV_RENAME"))
+	case ErrBusy:
+		return e.Err == unix.EBUSY && e.Cmd != "DM_DEV_CREATE" && e.Cmd != "DM_DEV_RENAME"
+	case ErrInvalidTable:
+		return e.Err == unix.EINVAL && e.Cmd == "DM_TABLE_LOAD"
+	}
+	return false
+}
+
+var cmdNames = map[uintptr]string{
+	unix.DM_VERSION:            "DM_VERSION",
+	unix.DM_REMOVE_ALL:         "DM_REMOVE_ALL",
+	unix.DM_LIST_DEVICES:       "DM_LIST_DEVICES",
+	unix.DM_DEV_CREATE:         "DM_DEV_CREATE",
+	unix.DM_DEV_REMOVE:         "DM_DEV_REMOVE",
+	unix.DM_DEV_RENAME:         "DM_DEV_RENAME",
+	unix.DM_DEV_SUSPEND:        "DM_DEV_SUSPEND",
+	unix.DM_DEV_STATUS:         "DM_DEV_STATUS",
+	unix.DM_DEV_WAIT:           "DM_DEV_WAIT",
+	unix.DM_DEV_ARM_POLL:       "DM_DEV_ARM_POLL",
+	unix.DM_TABLE_LOAD:         "DM_TABLE_LOAD",
+	unix.DM_TABLE_CLEAR:        "DM_TABLE_CLEAR",
+	unix.DM_TABLE_DEPS:         "DM_TABLE_DEPS",
+	unix.DM_TABLE_STATUS:       "DM_TABLE_STATUS",
+	unix.DM_LIST_VERSIONS:      "DM_LIST_VERSIONS",
+	unix.DM_TARGET_MSG:         "DM_TARGET_MSG",
+	unix.DM_DEV_SET_GEOMETRY:   "DM_DEV_SET_GEOMETRY",
+	unix.DM_GET_TARGET_VERSION: "DM_GET_TARGET_VERSION",
+}
+
+// cmdName returns a human readable name of the ioctl command
+func cmdName(cmd uintptr) string {
+	if name, ok := cmdNames[cmd]; ok {
+		return name
+	}
+	return fmt.Sprintf("0x%x", cmd)
+}
+
+// newError creates an Error for the failed ioctl, the device is taken from the dm_ioctl header in data
+func newError(cmd uintptr, data []byte, errno error) error {
+	e := &Error{Cmd: cmdName(cmd), Err: errno}
+	if len(data) >= unix.SizeofDmIoctl {
+		ioctlData := (*unix.DmIoctl)(unsafe.Pointer(&data[0]))
+		switch {
+		case ioctlData.Name[0] != 0:
+			e.Device = fixedArrayToString(ioctlData.Name[:])
+		case ioctlData.Uuid[0] != 0:
+			e.Device = fixedArrayToString(ioctlData.Uuid[:])
+		case ioctlData.Dev != 0:
+			e.Device = fmt.Sprintf("%d:%d", unix.Major(ioctlData.Dev), unix.Minor(ioctlData.Dev))
+		}
+	}
+	return e
+}
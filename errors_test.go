@@ -0,0 +1,60 @@
+package devmapper
+
+import (
+	"errors"
+	"testing"
+	"unsafe"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sys/unix"
+)
+
+func TestErrorIs(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		cmd      uintptr
+		errno    unix.Errno
+		sentinel error
+	}{
+		{unix.DM_DEV_STATUS, unix.ENXIO, ErrNotFound},
+		{unix.DM_DEV_REMOVE, unix.ENXIO, ErrNotFound},
+		{unix.DM_DEV_REMOVE, unix.EBUSY, ErrBusy},
+		{unix.DM_DEV_SUSPEND, unix.EBUSY, ErrBusy},
+		{unix.DM_DEV_CREATE, unix.EBUSY, ErrExists},
+		{unix.DM_DEV_RENAME, unix.EBUSY, ErrExists},
+		{unix.DM_DEV_CREATE, unix.EEXIST, ErrExists},
+		{unix.DM_TABLE_LOAD, unix.EINVAL, ErrInvalidTable},
+	}
+	sentinels := []error{ErrNotFound, ErrBusy, ErrExists, ErrInvalidTable}
+
+	for _, test := range tests {
+		err := newError(test.cmd, nil, test.errno)
+		require.ErrorIs(t, err, test.errno, "the kernel errno is still accessible")
+		for _, s := range sentinels {
+			require.Equal(t, s == test.sentinel, errors.Is(err, s), "%v vs %v", err, s)
+		}
+	}
+
+	require.NotErrorIs(t, newError(unix.DM_TARGET_MSG, nil, unix.EINVAL), ErrInvalidTable)
+}
+
+func TestErrorMessage(t *testing.T) {
+	t.Parallel()
+
+	data := make([]byte, unix.SizeofDmIoctl)
+	ioctlData := (*unix.DmIoctl)(unsafe.Pointer(&data[0]))
+
+	require.Equal(t, "dm ioctl DM_LIST_DEVICES: no such device or address", newError(unix.DM_LIST_DEVICES, data, unix.ENXIO).Error())
+
+	ioctlData.Dev = unix.Mkdev(253, 4)
+	require.Equal(t, "dm ioctl DM_DEV_STATUS 253:4: no such device or address", newError(unix.DM_DEV_STATUS, data, unix.ENXIO).Error())
+
+	copy(ioctlData.Uuid[:], "CRYPT-1234")
+	require.Equal(t, "dm ioctl DM_DEV_STATUS CRYPT-1234: no such device or address", newError(unix.DM_DEV_STATUS, data, unix.ENXIO).Error())
+
+	copy(ioctlData.Name[:], "test")
+	require.Equal(t, "dm ioctl DM_DEV_REMOVE test: device or resource busy", newError(unix.DM_DEV_REMOVE, data, unix.EBUSY).Error())
+
+	require.Equal(t, "dm ioctl 0x1234: invalid argument", newError(0x1234, nil, unix.EINVAL).Error())
+}
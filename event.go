@@ -0,0 +1,323 @@
+package devmapper
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// WaitEvent is a wrapper around Client.WaitEvent that uses the default client.
+func WaitEvent(name string, eventNr uint32) (uint32, []TargetStatus, error) {
+	return defaultClient.WaitEvent(name, eventNr)
+}
+
+// WaitEvent blocks until the device event counter differs from eventNr, i.e. until the device raises
+// an event after the moment eventNr was obtained (see DeviceInfo.EventNr).
+// It returns the new event counter and the targets status at the moment of the event.
+// Note that the wait cannot be cancelled, use Watch for cancellable waiting.
+func (c *Client) WaitEvent(name string, eventNr uint32) (uint32, []TargetStatus, error) {
+	ioctlData, out, err := c.ioctlWithOutput(unix.DM_DEV_WAIT, name, "", 0, eventNr, nil)
+	if err != nil {
+		return 0, nil, err
+	}
+	status, err := parseTargetStatus(ioctlData.Target_count, out)
+	if err != nil {
+		return 0, nil, err
+	}
+	return ioctlData.Event_nr, status, nil
+}
+
+// EventType is a type of the device event
+type EventType int
+
+const (
+	// EventChanged means that a target of the device raised an event e.g. verity detected corruption,
+	// thin-pool reached low-water mark, raid got degraded or a multipath path failed.
+	// Event.Status contains the targets status that can be inspected with TargetStatus.Parse()
+	EventChanged EventType = iota
+	// EventAdded means that a new device appeared. If Watch() watches specific devices then it is reported
+	// when a watched device is re-created after removal.
+	EventAdded
+	// EventRemoved means that the device has been removed
+	EventRemoved
+)
+
+// Event represents a device mapper event
+type Event struct {
+	Type    EventType
+	Name    string
+	DevNo   uint64
+	EventNr uint32
+	Status  []TargetStatus // targets status at the moment the event was observed, empty for EventRemoved
+}
+
+// Watcher delivers device mapper events, see Watch
+type Watcher struct {
+	// Events delivers the events. The channel is closed when the context is cancelled or an error occurs.
+	Events <-chan Event
+
+	mu  sync.Mutex
+	err error
+}
+
+// Err returns the error that stopped the watcher, nil if it was stopped by the context cancellation
+func (w *Watcher) Err() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.err
+}
+
+func (w *Watcher) setErr(err error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.err = err
+}
+
+// Watch is a wrapper around Client.Watch that uses the default client.
+func Watch(ctx context.Context, names ...string) (*Watcher, error) {
+	return defaultClient.Watch(ctx, names...)
+}
+
+// EventPoller is implemented by a Transport that supports Watch, e.g. the fake device mapper. It is an equivalent
+// of DM_DEV_ARM_POLL and poll(2) on the control node: every device creation, removal, rename or target event
+// increments the global event number.
+type EventPoller interface {
+	// GlobalEventNr returns the current global event number
+	GlobalEventNr() uint64
+	// WaitGlobalEvent blocks until the global event number differs from eventNr or the context is cancelled
+	WaitGlobalEvent(ctx context.Context, eventNr uint64) error
+}
+
+// eventSource wakes up the watcher when a device mapper event is raised
+type eventSource interface {
+	arm() error                     // an event raised after arm() wakes up wait()
+	wait(ctx context.Context) error // returns the context error if the context is cancelled
+	close()
+}
+
+// Watch watches the given devices (or all devices if no names given) for kernel events until the context is cancelled.
+// It uses DM_DEV_ARM_POLL and poll(2) on its own instance of the control node and requires kernel interface
+// 4.37 or newer. A client with a custom Transport supports Watch if the Transport implements EventPoller.
+func (c *Client) Watch(ctx context.Context, names ...string) (*Watcher, error) {
+	var src eventSource
+	if c.controlPath != "" {
+		var err error
+		src, err = openControlSource(ctx, c.controlPath)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		c.mu.Lock()
+		poller, ok := c.transport.(EventPoller)
+		c.mu.Unlock()
+		if !ok {
+			return nil, fmt.Errorf("watching events requires a client that uses the control node or a Transport that implements EventPoller")
+		}
+		src = &pollerSource{poller: poller}
+	}
+
+	err := src.arm()
+	var known map[string]ListItem
+	if err == nil {
+		known, err = c.eventNumbers(names)
+	}
+	if err == nil {
+		for _, name := range names {
+			if _, ok := known[name]; !ok {
+				err = fmt.Errorf("%s: %w", name, ErrNotFound)
+				break
+			}
+		}
+	}
+	if err != nil {
+		src.close()
+		return nil, err
+	}
+
+	events := make(chan Event)
+	w := &Watcher{Events: events}
+
+	go func() {
+		defer close(events)
+		defer src.close()
+
+		send := func(ev Event) bool {
+			select {
+			case events <- ev:
+				return true
+			case <-ctx.Done():
+				return false
+			}
+		}
+
+		for {
+			if err := src.wait(ctx); err != nil {
+				if ctx.Err() == nil {
+					w.setErr(err)
+				}
+				return
+			}
+
+			// re-arm before reading the event numbers so no event gets lost
+			if err := src.arm(); err != nil {
+				w.setErr(err)
+				return
+			}
+			current, err := c.eventNumbers(names)
+			if err != nil {
+				w.setErr(err)
+				return
+			}
+
+			for name, cur := range current {
+				prev, ok := known[name]
+				typ := EventChanged
+				switch {
+				case !ok:
+					typ = EventAdded
+				case prev.DevNo != cur.DevNo:
+					// the device has been removed and re-created with the same name between the polls
+					if !send(Event{Type: EventRemoved, Name: name, DevNo: prev.DevNo, EventNr: prev.EventNr}) {
+						return
+					}
+					typ = EventAdded
+				case prev.EventNr == cur.EventNr:
+					continue
+				}
+
+				ev := Event{Type: typ, Name: name, DevNo: cur.DevNo, EventNr: cur.EventNr}
+				ev.Status, err = c.Status(name)
+				if err != nil && !errors.Is(err, ErrNotFound) {
+					w.setErr(err)
+					return
+				}
+				if !send(ev) {
+					return
+				}
+			}
+			for name, prev := range known {
+				if _, ok := current[name]; ok {
+					continue
+				}
+				if !send(Event{Type: EventRemoved, Name: name, DevNo: prev.DevNo, EventNr: prev.EventNr}) {
+					return
+				}
+			}
+			known = current
+		}
+	}()
+
+	return w, nil
+}
+
+// controlSource polls its own instance of the control node
+type controlSource struct {
+	controlFile         *os.File
+	wakeRead, wakeWrite *os.File // the pipe wakes up poll(2) when the context is cancelled
+	stop                func() bool
+}
+
+func openControlSource(ctx context.Context, controlPath string) (*controlSource, error) {
+	controlFile, err := os.Open(controlPath)
+	if err != nil {
+		return nil, err
+	}
+	wakeRead, wakeWrite, err := os.Pipe()
+	if err != nil {
+		controlFile.Close()
+		return nil, err
+	}
+	s := &controlSource{controlFile: controlFile, wakeRead: wakeRead, wakeWrite: wakeWrite}
+	s.stop = context.AfterFunc(ctx, func() {
+		_, _ = wakeWrite.Write([]byte{0})
+	})
+	return s, nil
+}
+
+func (s *controlSource) arm() error {
+	return armPoll(s.controlFile)
+}
+
+func (s *controlSource) wait(ctx context.Context) error {
+	for {
+		fds := []unix.PollFd{
+			{Fd: int32(s.controlFile.Fd()), Events: unix.POLLIN},
+			{Fd: int32(s.wakeRead.Fd()), Events: unix.POLLIN},
+		}
+		if _, err := unix.Poll(fds, -1); err != nil {
+			if err == unix.EINTR {
+				continue
+			}
+			return os.NewSyscallError("poll", err)
+		}
+		if fds[1].Revents != 0 {
+			return context.Cause(ctx) // the pipe is written only when the context is cancelled
+		}
+		return ctx.Err()
+	}
+}
+
+func (s *controlSource) close() {
+	s.stop()
+	s.controlFile.Close()
+	s.wakeRead.Close()
+	s.wakeWrite.Close()
+}
+
+// pollerSource waits for the events using the client transport
+type pollerSource struct {
+	poller  EventPoller
+	eventNr uint64
+}
+
+func (s *pollerSource) arm() error {
+	s.eventNr = s.poller.GlobalEventNr()
+	return nil
+}
+
+func (s *pollerSource) wait(ctx context.Context) error {
+	return s.poller.WaitGlobalEvent(ctx, s.eventNr)
+}
+
+func (s *pollerSource) close() {}
+
+// armPoll arms the control file so poll(2) reports POLLIN once any device raises an event
+func armPoll(controlFile *os.File) error {
+	data := make([]byte, unix.SizeofDmIoctl)
+	ioctlData := (*unix.DmIoctl)(unsafe.Pointer(&data[0]))
+	ioctlData.Version = [...]uint32{4, 37, 0} // DM_DEV_ARM_POLL has been added in 4.37
+	ioctlData.Data_size = unix.SizeofDmIoctl
+	ioctlData.Data_start = unix.SizeofDmIoctl
+
+	if err := ioctlFd(controlFile.Fd(), unix.DM_DEV_ARM_POLL, data); err != nil {
+		return newError(unix.DM_DEV_ARM_POLL, data, err)
+	}
+	return nil
+}
+
+// eventNumbers returns current event numbers of the given devices, or of all devices if names is empty.
+// Devices that do not exist are omitted from the result.
+func (c *Client) eventNumbers(names []string) (map[string]ListItem, error) {
+	list, err := c.List()
+	if err != nil {
+		return nil, err
+	}
+
+	watched := make(map[string]bool, len(names))
+	for _, name := range names {
+		watched[name] = true
+	}
+
+	result := make(map[string]ListItem)
+	for _, l := range list {
+		if len(names) == 0 || watched[l.Name] {
+			result[l.Name] = l
+		}
+	}
+	return result, nil
+}
@@ -0,0 +1,54 @@
+package test
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/anatol/devmapper.go"
+	"github.com/stretchr/testify/require"
+)
+
+func TestClient(t *testing.T) {
+	c, err := devmapper.NewClient("")
+	require.NoError(t, err)
+	defer c.Close()
+
+	// the client is safe for concurrent use
+	const num = 20
+	var wg sync.WaitGroup
+	errs := make([]error, num)
+	for i := 0; i < num; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			name := fmt.Sprintf("test.client.%d", i)
+			z := devmapper.ZeroTable{Length: 200 * devmapper.SectorSize}
+			errs[i] = c.CreateAndLoad(name, "", 0, z)
+		}(i)
+	}
+	wg.Wait()
+	for i := 0; i < num; i++ {
+		defer c.Remove(fmt.Sprintf("test.client.%d", i))
+	}
+	for _, err := range errs {
+		require.NoError(t, err)
+	}
+
+	for i := 0; i < num; i++ {
+		name := fmt.Sprintf("test.client.%d", i)
+		info, err := c.InfoByName(name)
+		require.NoError(t, err)
+		require.Equal(t, name, info.Name)
+		require.Equal(t, uint32(1), info.TargetsNum)
+	}
+
+	for i := 0; i < num; i++ {
+		require.NoError(t, c.Remove(fmt.Sprintf("test.client.%d", i)))
+	}
+	list, err := c.List()
+	require.NoError(t, err)
+	for _, l := range list {
+		require.NotContains(t, l.Name, "test.client.")
+	}
+}
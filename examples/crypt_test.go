@@ -206,3 +206,93 @@ func TestCryptTargetUserspaceReadCustomSectorSize(t *testing.T) {
 	require.NoError(t, err)
 	require.Equal(t, expected, buf)
 }
+
+func TestCryptOpenVolume(t *testing.T) {
+	name := "test.crypttarget.openvolume"
+
+	dir := t.TempDir()
+	backingFile := dir + "/backing"
+	size := uint64(40) * devmapper.SectorSize
+	require.NoError(t, os.WriteFile(backingFile, make([]byte, size), 0o644))
+
+	loop, err := losetup.Attach(backingFile, 0, false)
+	require.NoError(t, err)
+	defer loop.Detach()
+
+	key := make([]byte, 32)
+	rand.Read(key)
+	c := devmapper.CryptTable{
+		Length:        size,
+		Encryption:    "aes-xts-plain64",
+		Key:           key,
+		BackendDevice: loop.Path(),
+	}
+	require.NoError(t, devmapper.CreateAndLoad(name, "", 0, c))
+	defer devmapper.Remove(name)
+	require.NoError(t, waitForFile("/dev/mapper/"+name))
+
+	kernel, err := devmapper.OpenVolume(name, os.O_RDWR, 0)
+	require.NoError(t, err)
+	defer kernel.Close()
+
+	expected := make([]byte, 8*devmapper.SectorSize)
+	rand.Read(expected)
+	_, err = kernel.WriteAt(expected, 4*devmapper.SectorSize)
+	require.NoError(t, err)
+	require.NoError(t, kernel.(*os.File).Sync())
+
+	userspace, err := devmapper.OpenUserspaceVolumeByName(name, os.O_RDONLY, 0)
+	require.NoError(t, err)
+	defer userspace.Close()
+
+	buf := make([]byte, len(expected))
+	_, err = userspace.ReadAt(buf, 4*devmapper.SectorSize)
+	require.NoError(t, err)
+	require.Equal(t, expected, buf)
+}
+
+func TestCryptTargetUserspaceCipherModes(t *testing.T) {
+	for _, encryption := range []string{
+		"aes-cbc-plain", "aes-cbc-plain64", "aes-cbc-plain64be", "aes-cbc-essiv:sha256", "aes-cbc-benbi", "aes-cbc-null",
+		"aes-xts-plain", "aes-xts-plain64be", "aes-xts-essiv:sha256", "aes-ecb",
+	} {
+		t.Run(encryption, func(t *testing.T) {
+			name := "test.crypttarget.modes"
+			dir := t.TempDir()
+			backingFile := dir + "/backing"
+			size := uint64(40) * devmapper.SectorSize
+			require.NoError(t, os.WriteFile(backingFile, make([]byte, size), 0o600))
+
+			loop, err := losetup.Attach(backingFile, 0, false)
+			require.NoError(t, err)
+			defer loop.Detach()
+
+			key := make([]byte, 32)
+			rand.Read(key)
+			c := devmapper.CryptTable{
+				Length:        size,
+				Encryption:    encryption,
+				Key:           key,
+				BackendDevice: loop.Path(),
+				IVTweak:       3,
+			}
+			require.NoError(t, devmapper.CreateAndLoad(name, "", 0, c))
+			defer devmapper.Remove(name)
+
+			fname := "/dev/mapper/" + name
+			require.NoError(t, waitForFile(fname))
+			expected := make([]byte, size)
+			rand.Read(expected)
+			require.NoError(t, os.WriteFile(fname, expected, 0))
+
+			c.BackendDevice = backingFile
+			v, err := devmapper.OpenUserspaceVolume(os.O_RDONLY, 0, c)
+			require.NoError(t, err)
+			defer v.Close()
+			buf := make([]byte, size)
+			_, err = v.ReadAt(buf, 0)
+			require.NoError(t, err)
+			require.Equal(t, expected, buf)
+		})
+	}
+}
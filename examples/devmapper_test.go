@@ -6,7 +6,9 @@ import (
 	"os/exec"
 	"regexp"
 	"strconv"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/anatol/devmapper.go"
 	"github.com/freddierice/go-losetup/v2"
@@ -45,6 +47,8 @@ func TestCreate(t *testing.T) {
 			expectedDevNo := got["Major, minor"]
 			gotDevNo := fmt.Sprintf("%d, %d", unix.Major(l.DevNo), unix.Minor(l.DevNo))
 			require.Equal(t, expectedDevNo, gotDevNo)
+			require.Equal(t, uuid, l.UUID)
+			require.Equal(t, got[PropEventNumber], strconv.Itoa(int(l.EventNr)))
 			found = true
 			break
 		}
@@ -334,3 +338,427 @@ func TestUserspaceJoinedDevicesWrite(t *testing.T) {
 		require.Equal(t, expectedData, buf)
 	}
 }
+
+func TestMessage(t *testing.T) {
+	name := "test.message"
+	uuid := "1b9d0a4e-6f53-4d3c-9f2e-5a0c3b6f8d21"
+	z := devmapper.ZeroTable{Length: 200 * devmapper.SectorSize}
+	require.NoError(t, devmapper.CreateAndLoad(name, uuid, 0, z))
+	defer devmapper.Remove(name)
+
+	// dm-stats messages are handled by the device mapper core and work with any target
+	out, err := devmapper.Message(name, 0, "@stats_list")
+	require.NoError(t, err)
+	require.Equal(t, "", out)
+
+	out, err = devmapper.Message(name, 0, "@stats_create - /1")
+	require.NoError(t, err)
+	require.Equal(t, "0", strings.TrimSpace(out), "expected id of the created stats region")
+
+	out, err = devmapper.Message(name, 0, "@stats_list")
+	require.NoError(t, err)
+	require.Contains(t, out, "0: 0+200")
+
+	out, err = devmapper.Message(name, 0, "@stats_delete 0")
+	require.NoError(t, err)
+	require.Equal(t, "", out)
+
+	_, err = devmapper.Message(name, 0, "no_such_message")
+	require.Error(t, err)
+}
+
+func TestRename(t *testing.T) {
+	name := "test.rename.staging"
+	newName := "test.rename"
+	uuid := "7c0e1d1a-3b36-4a5f-8f4b-2d5f0c1e9a47"
+	z := devmapper.ZeroTable{Length: 200 * devmapper.SectorSize}
+	require.NoError(t, devmapper.CreateAndLoad(name, uuid, 0, z))
+
+	require.NoError(t, devmapper.Rename(name, newName))
+	defer devmapper.Remove(newName)
+
+	_, err := devInfo(name)
+	require.Error(t, err, "device with old name should not exist")
+
+	got, err := devInfo(newName)
+	require.NoError(t, err)
+	checkDevInfo(t, got, map[string]string{
+		PropName: newName,
+		PropUUID: uuid,
+	})
+	require.NoError(t, waitForFile("/dev/mapper/"+newName))
+}
+
+func TestSetUUID(t *testing.T) {
+	name := "test.setuuid"
+	uuid := "0e4f2b9c-5d1a-4c7e-9b3f-6a2d8e1c4f50"
+	require.NoError(t, devmapper.Create(name, ""))
+	defer devmapper.Remove(name)
+
+	info, err := devmapper.InfoByName(name)
+	require.NoError(t, err)
+	require.Equal(t, "", info.UUID)
+
+	require.NoError(t, devmapper.SetUUID(name, uuid))
+
+	got, err := devInfo(name)
+	require.NoError(t, err)
+	checkDevInfo(t, got, map[string]string{
+		PropName: name,
+		PropUUID: uuid,
+	})
+
+	// uuid can be set only once
+	err = devmapper.SetUUID(name, "5a1c3e7f-9b2d-4f6a-8c0e-1d3b5f7a9c2e")
+	require.ErrorIs(t, err, devmapper.ErrUUIDAlreadySet)
+}
+
+func TestTables(t *testing.T) {
+	name := "test.tables"
+	uuid := "3d2a6c1e-8f4b-4e9a-b7c5-0a1f2e3d4c5b"
+
+	dir := t.TempDir()
+	backingFile := dir + "/backing"
+	f, err := os.Create(backingFile)
+	require.NoError(t, err)
+	require.NoError(t, f.Truncate(50*devmapper.SectorSize))
+	require.NoError(t, f.Close())
+
+	loop, err := losetup.Attach(backingFile, 0, false)
+	require.NoError(t, err)
+	defer loop.Detach()
+
+	var st unix.Stat_t
+	require.NoError(t, unix.Stat(loop.Path(), &st))
+	loopDevNo := fmt.Sprintf("%d:%d", unix.Major(st.Rdev), unix.Minor(st.Rdev))
+
+	l := devmapper.LinearTable{
+		Length:        20 * devmapper.SectorSize,
+		BackendDevice: loop.Path(),
+		BackendOffset: 5 * devmapper.SectorSize,
+	}
+	z := devmapper.ZeroTable{
+		Start:  20 * devmapper.SectorSize,
+		Length: 10 * devmapper.SectorSize,
+	}
+	require.NoError(t, devmapper.Create(name, uuid))
+	defer devmapper.Remove(name)
+	require.NoError(t, devmapper.Load(name, 0, l, z))
+
+	// the table is loaded but the device is not resumed yet
+	live, err := devmapper.Tables(name, false)
+	require.NoError(t, err)
+	require.Empty(t, live)
+
+	l.BackendDevice = loopDevNo // kernel reports devices in major:minor format
+	expected := []devmapper.Table{l, z}
+
+	inactive, err := devmapper.Tables(name, true)
+	require.NoError(t, err)
+	require.Equal(t, expected, inactive)
+
+	require.NoError(t, devmapper.Resume(name))
+
+	live, err = devmapper.Tables(name, false)
+	require.NoError(t, err)
+	require.Equal(t, expected, live)
+}
+
+func TestRawTable(t *testing.T) {
+	name := "test.rawtable"
+	uuid := "9a8b7c6d-5e4f-4a3b-8c2d-1e0f9a8b7c6d"
+
+	// 'error' target is not modelled by the library, every IO to it fails
+	e := devmapper.RawTable{
+		Length: 8 * devmapper.SectorSize,
+		Type:   "error",
+	}
+	z := devmapper.ZeroTable{
+		Start:  8 * devmapper.SectorSize,
+		Length: 24 * devmapper.SectorSize,
+	}
+	require.NoError(t, devmapper.CreateAndLoad(name, uuid, 0, e, z))
+	defer devmapper.Remove(name)
+
+	tables, err := devmapper.Tables(name, false)
+	require.NoError(t, err)
+	require.Equal(t, []devmapper.Table{e, z}, tables)
+
+	mapper := "/dev/mapper/" + name
+	require.NoError(t, waitForFile(mapper))
+
+	f, err := os.Open(mapper)
+	require.NoError(t, err)
+	defer f.Close()
+
+	// both parts are page aligned so the page cache does not mix them up
+	buf := make([]byte, 4096)
+	_, err = f.ReadAt(buf, 8*devmapper.SectorSize)
+	require.NoError(t, err, "zero part of the device should be readable")
+	_, err = f.ReadAt(buf, 0)
+	require.ErrorIs(t, err, unix.EIO)
+}
+
+func TestTopology(t *testing.T) {
+	dir := t.TempDir()
+	backingFile := dir + "/backing"
+	f, err := os.Create(backingFile)
+	require.NoError(t, err)
+	require.NoError(t, f.Truncate(40*devmapper.SectorSize))
+	require.NoError(t, f.Close())
+
+	loop, err := losetup.Attach(backingFile, 0, false)
+	require.NoError(t, err)
+	defer loop.Detach()
+
+	var st unix.Stat_t
+	require.NoError(t, unix.Stat(loop.Path(), &st))
+	loopDevNo := uint64(st.Rdev)
+
+	linearName := "test.topology.linear"
+	l := devmapper.LinearTable{
+		Length:        40 * devmapper.SectorSize,
+		BackendDevice: loop.Path(),
+	}
+	require.NoError(t, devmapper.CreateAndLoad(linearName, "", 0, l))
+	defer devmapper.Remove(linearName)
+	require.NoError(t, waitForFile("/dev/mapper/"+linearName))
+
+	cryptName := "test.topology.crypt"
+	c := devmapper.CryptTable{
+		Length:        40 * devmapper.SectorSize,
+		Encryption:    "aes-xts-plain64",
+		Key:           make([]byte, 32),
+		BackendDevice: "/dev/mapper/" + linearName,
+	}
+	require.NoError(t, devmapper.CreateAndLoad(cryptName, "", 0, c))
+	defer devmapper.Remove(cryptName)
+
+	linearInfo, err := devmapper.InfoByName(linearName)
+	require.NoError(t, err)
+	cryptInfo, err := devmapper.InfoByName(cryptName)
+	require.NoError(t, err)
+
+	deps, err := devmapper.Deps(linearName)
+	require.NoError(t, err)
+	require.Equal(t, []uint64{loopDevNo}, deps)
+	deps, err = devmapper.Deps(cryptName)
+	require.NoError(t, err)
+	require.Equal(t, []uint64{linearInfo.DevNo}, deps)
+
+	g, err := devmapper.Topology()
+	require.NoError(t, err)
+	holders := g.HoldersOf(loopDevNo)
+	require.Len(t, holders, 2)
+	require.Equal(t, cryptInfo.DevNo, holders[0].DevNo)
+	require.Equal(t, linearInfo.DevNo, holders[1].DevNo)
+	require.Contains(t, g.String(), cryptName)
+}
+
+func TestRemoveTree(t *testing.T) {
+	dir := t.TempDir()
+	backingFile := dir + "/backing"
+	f, err := os.Create(backingFile)
+	require.NoError(t, err)
+	require.NoError(t, f.Truncate(40*devmapper.SectorSize))
+	require.NoError(t, f.Close())
+
+	loop, err := losetup.Attach(backingFile, 0, false)
+	require.NoError(t, err)
+	defer loop.Detach()
+
+	linearName := "test.removetree.linear"
+	l := devmapper.LinearTable{
+		Length:        40 * devmapper.SectorSize,
+		BackendDevice: loop.Path(),
+	}
+	require.NoError(t, devmapper.CreateAndLoad(linearName, "", 0, l))
+	defer devmapper.Remove(linearName)
+	require.NoError(t, waitForFile("/dev/mapper/"+linearName))
+
+	// two crypt devices share the same linear device
+	cryptName1 := "test.removetree.crypt1"
+	cryptName2 := "test.removetree.crypt2"
+	for _, name := range []string{cryptName1, cryptName2} {
+		c := devmapper.CryptTable{
+			Length:        40 * devmapper.SectorSize,
+			Encryption:    "aes-xts-plain64",
+			Key:           make([]byte, 32),
+			BackendDevice: "/dev/mapper/" + linearName,
+		}
+		require.NoError(t, devmapper.CreateAndLoad(name, "", 0, c))
+		defer devmapper.Remove(name)
+	}
+
+	removed, err := devmapper.RemoveTree(cryptName1, devmapper.RemoveTreeOptions{DryRun: true})
+	require.NoError(t, err)
+	require.Equal(t, []string{cryptName1}, removed)
+	_, err = devmapper.InfoByName(cryptName1)
+	require.NoError(t, err, "dry run should not remove devices")
+
+	// linear device is still used by crypt2
+	removed, err = devmapper.RemoveTree(cryptName1, devmapper.RemoveTreeOptions{})
+	require.NoError(t, err)
+	require.Equal(t, []string{cryptName1}, removed)
+	_, err = devmapper.InfoByName(cryptName1)
+	require.Error(t, err)
+	_, err = devmapper.InfoByName(linearName)
+	require.NoError(t, err)
+
+	removed, err = devmapper.RemoveTree(cryptName2, devmapper.RemoveTreeOptions{DryRun: true})
+	require.NoError(t, err)
+	require.Equal(t, []string{cryptName2, linearName}, removed)
+
+	removed, err = devmapper.RemoveTree(cryptName2, devmapper.RemoveTreeOptions{})
+	require.NoError(t, err)
+	require.Equal(t, []string{cryptName2, linearName}, removed)
+	_, err = devmapper.InfoByName(linearName)
+	require.ErrorIs(t, err, devmapper.ErrNotFound)
+}
+
+func TestErrors(t *testing.T) {
+	name := "test.errors"
+	z := devmapper.ZeroTable{Length: 200 * devmapper.SectorSize}
+	require.NoError(t, devmapper.CreateAndLoad(name, "", 0, z))
+	defer devmapper.Remove(name)
+
+	err := devmapper.Create(name, "")
+	require.ErrorIs(t, err, devmapper.ErrExists)
+	require.ErrorContains(t, err, "DM_DEV_CREATE "+name)
+
+	err = devmapper.Load(name, 0, devmapper.RawTable{Length: 200 * devmapper.SectorSize, Type: "nonexistent-target"})
+	require.ErrorIs(t, err, devmapper.ErrInvalidTable)
+
+	require.NoError(t, waitForFile("/dev/mapper/"+name))
+	f, err := os.Open("/dev/mapper/" + name)
+	require.NoError(t, err)
+	err = devmapper.Remove(name)
+	require.ErrorIs(t, err, devmapper.ErrBusy)
+	require.NoError(t, f.Close())
+
+	require.NoError(t, devmapper.Remove(name))
+	err = devmapper.Remove(name)
+	require.ErrorIs(t, err, devmapper.ErrNotFound)
+	require.ErrorIs(t, err, unix.ENXIO)
+}
+
+func TestSuspendWithOptions(t *testing.T) {
+	name := "test.suspend"
+	z := devmapper.ZeroTable{Length: 200 * devmapper.SectorSize}
+	require.NoError(t, devmapper.CreateAndLoad(name, "", 0, z))
+	defer devmapper.Remove(name)
+
+	suspended, err := devmapper.SuspendWithOptions(name, devmapper.SuspendOptions{NoFlush: true, SkipLockfs: true})
+	require.NoError(t, err)
+	require.True(t, suspended)
+
+	got, err := devInfo(name)
+	require.NoError(t, err)
+	checkDevInfo(t, got, map[string]string{
+		PropState: "SUSPENDED",
+	})
+
+	require.NoError(t, devmapper.Resume(name))
+	got, err = devInfo(name)
+	require.NoError(t, err)
+	checkDevInfo(t, got, map[string]string{
+		PropState: "ACTIVE",
+	})
+}
+
+func TestUdevSync(t *testing.T) {
+	for _, mode := range []devmapper.UdevSync{devmapper.UdevSyncCookie, devmapper.UdevSyncMknod} {
+		c, err := devmapper.NewClient("")
+		require.NoError(t, err)
+		defer c.Close()
+		c.SetUdevSync(mode)
+
+		name := fmt.Sprintf("test.udevsync.%d", mode)
+		newName := name + ".renamed"
+		z := devmapper.ZeroTable{Length: 200 * devmapper.SectorSize}
+		require.NoError(t, c.CreateAndLoad(name, "", 0, z))
+		defer c.Remove(name)
+
+		// the node is ready right after the device is resumed
+		info, err := c.InfoByName(name)
+		require.NoError(t, err)
+		var st unix.Stat_t
+		require.NoError(t, unix.Stat("/dev/mapper/"+name, &st))
+		require.Equal(t, info.DevNo, uint64(st.Rdev))
+
+		require.NoError(t, c.Rename(name, newName))
+		defer c.Remove(newName)
+		require.NoFileExists(t, "/dev/mapper/"+name)
+		require.NoError(t, unix.Stat("/dev/mapper/"+newName, &st))
+		require.Equal(t, info.DevNo, uint64(st.Rdev))
+
+		require.NoError(t, c.Remove(newName))
+		require.NoFileExists(t, "/dev/mapper/"+newName)
+	}
+}
+
+func TestRemoveWithOptions(t *testing.T) {
+	name := "test.remove.retry"
+	z := devmapper.ZeroTable{Length: 200 * devmapper.SectorSize}
+	require.NoError(t, devmapper.CreateAndLoad(name, "", 0, z))
+	require.NoError(t, waitForFile("/dev/mapper/"+name))
+
+	f, err := os.Open("/dev/mapper/" + name)
+	require.NoError(t, err)
+	go func() {
+		time.Sleep(300 * time.Millisecond)
+		f.Close()
+	}()
+	require.NoError(t, devmapper.RemoveWithOptions(name, devmapper.RemoveOptions{Retries: 10}))
+
+	name = "test.remove.deferred"
+	require.NoError(t, devmapper.CreateAndLoad(name, "", 0, z))
+	defer devmapper.Remove(name)
+	require.NoError(t, waitForFile("/dev/mapper/"+name))
+
+	f, err = os.Open("/dev/mapper/" + name)
+	require.NoError(t, err)
+	require.NoError(t, devmapper.RemoveWithOptions(name, devmapper.RemoveOptions{Deferred: true}))
+	info, err := devmapper.InfoByName(name)
+	require.NoError(t, err)
+	require.NotZero(t, info.Flags&unix.DM_DEFERRED_REMOVE)
+
+	require.NoError(t, devmapper.CancelDeferredRemove(name))
+	info, err = devmapper.InfoByName(name)
+	require.NoError(t, err)
+	require.Zero(t, info.Flags&unix.DM_DEFERRED_REMOVE)
+
+	require.NoError(t, devmapper.RemoveWithOptions(name, devmapper.RemoveOptions{Deferred: true}))
+	require.NoError(t, f.Close())
+	_, err = devmapper.InfoByName(name)
+	require.ErrorIs(t, err, devmapper.ErrNotFound, "the device is removed on last close")
+}
+
+func TestInfoByUUID(t *testing.T) {
+	prefix := "TEST-OWNER-"
+	names := []string{"test.uuidprefix1", "test.uuidprefix2"}
+	uuids := []string{prefix + "4f0c2a9e-1b7d-4e3a-9c5f-8d6b2a1e0f3c", prefix + "a3e1c5d7-9f2b-4d6e-8a0c-1b3d5f7e9a2c"}
+	for i, name := range names {
+		require.NoError(t, devmapper.Create(name, uuids[i]))
+		defer devmapper.Remove(name)
+	}
+	other := "test.uuidprefix.other"
+	require.NoError(t, devmapper.Create(other, "OTHER-6c8e0a2b-4d6f-4a1c-9e3b-5d7f9a1c3e5b"))
+	defer devmapper.Remove(other)
+
+	info, err := devmapper.InfoByUUID(uuids[1])
+	require.NoError(t, err)
+	require.Equal(t, names[1], info.Name)
+	require.Equal(t, uuids[1], info.UUID)
+
+	_, err = devmapper.InfoByUUID(prefix + "nonexistent")
+	require.ErrorIs(t, err, devmapper.ErrNotFound)
+
+	list, err := devmapper.ListByUUIDPrefix(prefix)
+	require.NoError(t, err)
+	require.Len(t, list, 2)
+	for _, l := range list {
+		require.Contains(t, names, l.Name)
+		require.True(t, strings.HasPrefix(l.UUID, prefix))
+	}
+}
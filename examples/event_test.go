@@ -0,0 +1,78 @@
+package test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/anatol/devmapper.go"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWaitEvent(t *testing.T) {
+	name := "test.waitevent"
+	newName := "test.waitevent.renamed"
+	z := devmapper.ZeroTable{Length: 200 * devmapper.SectorSize}
+	require.NoError(t, devmapper.CreateAndLoad(name, "", 0, z))
+	defer devmapper.Remove(newName)
+	defer devmapper.Remove(name)
+
+	info, err := devmapper.InfoByName(name)
+	require.NoError(t, err)
+
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		// rename wakes up the device event waiters
+		_ = devmapper.Rename(name, newName)
+	}()
+
+	eventNr, status, err := devmapper.WaitEvent(name, info.EventNr)
+	require.NoError(t, err)
+	require.Greater(t, eventNr, info.EventNr)
+	require.Len(t, status, 1)
+	require.Equal(t, "zero", status[0].Type)
+
+	renamed, err := devmapper.InfoByName(newName)
+	require.NoError(t, err)
+	require.Equal(t, eventNr, renamed.EventNr)
+}
+
+func TestWatch(t *testing.T) {
+	name := "test.watch"
+	newName := "test.watch.renamed"
+	z := devmapper.ZeroTable{Length: 200 * devmapper.SectorSize}
+	require.NoError(t, devmapper.CreateAndLoad(name, "", 0, z))
+	defer devmapper.Remove(newName)
+	defer devmapper.Remove(name)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	w, err := devmapper.Watch(ctx)
+	require.NoError(t, err)
+
+	require.NoError(t, devmapper.Rename(name, newName))
+
+	seen := make(map[string]devmapper.EventType)
+	for ev := range w.Events {
+		if ev.Name == name || ev.Name == newName {
+			seen[ev.Name] = ev.Type
+		}
+		if len(seen) == 2 {
+			break
+		}
+	}
+	require.Equal(t, map[string]devmapper.EventType{
+		name:    devmapper.EventRemoved,
+		newName: devmapper.EventAdded,
+	}, seen)
+
+	cancel()
+	for range w.Events {
+		// drain the channel until the watcher stops
+	}
+	require.NoError(t, w.Err())
+
+	_, err = devmapper.Watch(context.Background(), "test.watch.nonexistent")
+	require.Error(t, err)
+}
@@ -7,6 +7,7 @@ import (
 	"github.com/anatol/devmapper.go"
 	"github.com/freddierice/go-losetup/v2"
 	"github.com/stretchr/testify/require"
+	"golang.org/x/sys/unix"
 )
 
 func TestLinear(t *testing.T) {
@@ -55,3 +56,49 @@ func TestLinear(t *testing.T) {
 	copy(expectedData, text)
 	require.Equal(t, expectedData, data, "data read from the mapper differs from the backing file")
 }
+
+func TestLinearReload(t *testing.T) {
+	name := "test.linear.reload"
+
+	dir := t.TempDir()
+	backingFile := dir + "/backing"
+	require.NoError(t, os.WriteFile(backingFile, make([]byte, 64*1024), 0o644))
+
+	loop, err := losetup.Attach(backingFile, 0, false)
+	require.NoError(t, err)
+	defer loop.Detach()
+
+	l := devmapper.LinearTable{
+		Length:        16 * devmapper.SectorSize,
+		BackendDevice: loop.Path(),
+	}
+	require.NoError(t, devmapper.CreateAndLoad(name, "", 0, l))
+	defer devmapper.Remove(name)
+
+	mapper := "/dev/mapper/" + name
+	require.NoError(t, waitForFile(mapper))
+
+	// grow the device
+	l.Length = 64 * devmapper.SectorSize
+	require.NoError(t, devmapper.Reload(name, devmapper.ReloadOptions{}, l))
+	data, err := os.ReadFile(mapper)
+	require.NoError(t, err)
+	require.Equal(t, 64*devmapper.SectorSize, len(data))
+
+	// an invalid table keeps the old one
+	err = devmapper.Reload(name, devmapper.ReloadOptions{NoFlush: true}, devmapper.RawTable{Length: 128 * devmapper.SectorSize, Type: "nonexistent"})
+	require.ErrorIs(t, err, devmapper.ErrInvalidTable)
+
+	info, err := devmapper.InfoByName(name)
+	require.NoError(t, err)
+	require.Zero(t, info.Flags&(devmapper.ReadOnlyFlag|unix.DM_SUSPEND_FLAG|unix.DM_INACTIVE_PRESENT_FLAG))
+	tables, err := devmapper.Tables(name, false)
+	require.NoError(t, err)
+	require.Len(t, tables, 1)
+	require.Equal(t, l.Length, tables[0].(devmapper.LinearTable).Length)
+
+	require.NoError(t, devmapper.Reload(name, devmapper.ReloadOptions{Flags: devmapper.ReadOnlyFlag, NoFlush: true, SkipLockfs: true}, l))
+	info, err = devmapper.InfoByName(name)
+	require.NoError(t, err)
+	require.NotZero(t, info.Flags&devmapper.ReadOnlyFlag)
+}
@@ -1,8 +1,10 @@
 package test
 
 import (
+	"crypto/rand"
 	"os"
 	"os/exec"
+	"strconv"
 	"testing"
 
 	"github.com/anatol/devmapper.go"
@@ -82,6 +84,27 @@ func TestVerity(t *testing.T) {
 	copy(expectedData, "Hello verity!!!!")
 	require.Equal(t, expectedData, data, "data read from the mapper differs from the backing file")
 
+	status, err := devmapper.Status(name)
+	require.NoError(t, err)
+	require.Len(t, status, 1)
+	require.Equal(t, "verity", status[0].Type)
+	require.Equal(t, dataSize, status[0].Length)
+	parsed, err := status[0].Parse()
+	require.NoError(t, err)
+	require.Equal(t, &devmapper.VerityStatus{Corrupted: false}, parsed)
+
+	// verify the same data in userspace
+	uv := v
+	uv.DataDevice = dir + "/data"
+	uv.HashDevice = dir + "/hash"
+	vol, err := devmapper.OpenUserspaceVolume(os.O_RDONLY, 0, uv)
+	require.NoError(t, err)
+	defer vol.Close()
+	buf := make([]byte, len(expectedData))
+	_, err = vol.ReadAt(buf, 0)
+	require.NoError(t, err)
+	require.Equal(t, expectedData, buf)
+
 	// Now corrupt the backing file (flip the first character from H to h)
 	// verity should fail
 	_, err = d.WriteAt([]byte{'h'}, 0)
@@ -89,4 +112,209 @@ func TestVerity(t *testing.T) {
 	_, err = os.ReadFile(mapper)
 	require.NotNil(t, "expected EIO if backing device is corrupted")
 	require.ErrorIs(t, err, unix.EIO, "unexpected error on verity corruption")
+
+	status, err = devmapper.Status(name)
+	require.NoError(t, err)
+	parsed, err = status[0].Parse()
+	require.NoError(t, err)
+	require.Equal(t, &devmapper.VerityStatus{Corrupted: true}, parsed)
+
+	vol, err = devmapper.OpenUserspaceVolume(os.O_RDONLY, 0, uv)
+	require.NoError(t, err)
+	defer vol.Close()
+	_, err = vol.ReadAt(buf, 0)
+	var corruption *devmapper.VerityCorruptionError
+	require.ErrorAs(t, err, &corruption)
+	require.Equal(t, uint64(0), corruption.Block)
+}
+
+func TestVerityFormat(t *testing.T) {
+	dir := t.TempDir()
+
+	data := make([]byte, 1000*4096)
+	_, err := rand.Read(data)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(dir+"/data", data, 0o600))
+	salt, err := randomHex(32)
+	require.NoError(t, err)
+	uuid := "79639465-407e-4af6-b76b-d98a70c0d5d3"
+
+	for _, superblock := range []bool{false, true} {
+		require.NoError(t, os.WriteFile(dir+"/hash", nil, 0o600))
+		require.NoError(t, os.WriteFile(dir+"/hash.veritysetup", nil, 0o600))
+
+		v, err := devmapper.FormatVerity(devmapper.VerityTable{
+			HashType:   1,
+			DataDevice: dir + "/data",
+			HashDevice: dir + "/hash",
+			Algorithm:  "sha256",
+			Salt:       salt,
+		}, devmapper.VerityFormatOptions{Superblock: superblock, UUID: uuid})
+		require.NoError(t, err)
+
+		args := []string{"format", "--salt", salt, "--uuid", uuid, dir + "/data", dir + "/hash.veritysetup"}
+		if !superblock {
+			args = append(args, "--no-superblock")
+		}
+		out, err := exec.Command("veritysetup", args...).Output()
+		require.NoError(t, err)
+		props, err := parseProperties(out)
+		require.NoError(t, err)
+		require.Equal(t, props["Root hash"], v.Digest)
+
+		// the hash device content must be byte-to-byte identical to what veritysetup produces
+		got, err := os.ReadFile(dir + "/hash")
+		require.NoError(t, err)
+		expected, err := os.ReadFile(dir + "/hash.veritysetup")
+		require.NoError(t, err)
+		require.Equal(t, expected, got)
+	}
+}
+
+func TestVeritySuperblock(t *testing.T) {
+	dir := t.TempDir()
+
+	require.NoError(t, os.WriteFile(dir+"/data", make([]byte, 512*4096), 0o600))
+	require.NoError(t, os.WriteFile(dir+"/hash", nil, 0o600))
+	out, err := exec.Command("veritysetup", "format", "--data-block-size", "1024", "--hash", "sha512", dir+"/data", dir+"/hash").Output()
+	require.NoError(t, err)
+	props, err := parseProperties(out)
+	require.NoError(t, err)
+
+	v, uuid, err := devmapper.ReadVeritySuperblock(dir+"/hash", 0)
+	require.NoError(t, err)
+	require.Equal(t, props["UUID"], uuid)
+	require.Equal(t, props["Hash type"], strconv.FormatUint(v.HashType, 10))
+	require.Equal(t, props["Data blocks"], strconv.FormatUint(v.NumDataBlocks, 10))
+	require.Equal(t, props["Data block size"], strconv.FormatUint(v.DataBlockSize, 10))
+	require.Equal(t, props["Hash block size"], strconv.FormatUint(v.HashBlockSize, 10))
+	require.Equal(t, props["Hash algorithm"], v.Algorithm)
+	require.Equal(t, props["Salt"], v.Salt)
+	require.Equal(t, uint64(1), v.HashStartBlock)
+
+	// the table read from the superblock together with the root hash is enough to verify the data
+	v.DataDevice = dir + "/data"
+	v.Digest = props["Root hash"]
+	vol, err := devmapper.OpenUserspaceVolume(os.O_RDONLY, 0, v)
+	require.NoError(t, err)
+	defer vol.Close()
+	buf := make([]byte, v.Length)
+	_, err = vol.ReadAt(buf, 0)
+	require.NoError(t, err)
+}
+
+func TestVerityOptionalParams(t *testing.T) {
+	dir := t.TempDir()
+
+	require.NoError(t, os.WriteFile(dir+"/data", make([]byte, 256*4096), 0o600))
+	require.NoError(t, os.WriteFile(dir+"/hash", make([]byte, 16*4096), 0o600))
+	dLoop, err := losetup.Attach(dir+"/data", 0, true)
+	require.NoError(t, err)
+	defer dLoop.Detach()
+	hLoop, err := losetup.Attach(dir+"/hash", 0, false)
+	require.NoError(t, err)
+	defer hLoop.Detach()
+
+	v, err := devmapper.FormatVerity(devmapper.VerityTable{
+		HashType:   1,
+		DataDevice: dLoop.Path(),
+		HashDevice: hLoop.Path(),
+	}, devmapper.VerityFormatOptions{})
+	require.NoError(t, err)
+	v.CorruptionMode = devmapper.VerityCorruptionIgnore
+	v.IgnoreZeroBlocks = true
+	v.CheckAtMostOnce = true
+
+	name := "test.verity.params"
+	require.NoError(t, devmapper.CreateAndLoad(name, "", devmapper.ReadOnlyFlag, v))
+	defer devmapper.Remove(name)
+
+	tables, err := devmapper.Tables(name, false)
+	require.NoError(t, err)
+	require.Len(t, tables, 1)
+	got, ok := tables[0].(devmapper.VerityTable)
+	require.True(t, ok)
+	require.Equal(t, devmapper.VerityCorruptionIgnore, got.CorruptionMode)
+	require.True(t, got.IgnoreZeroBlocks)
+	require.True(t, got.CheckAtMostOnce)
+	require.Empty(t, got.Params)
+}
+
+func TestVerityFEC(t *testing.T) {
+	dir := t.TempDir()
+
+	data := make([]byte, 300*4096)
+	_, err := rand.Read(data)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(dir+"/data", data, 0o600))
+	for _, f := range []string{"hash", "fec", "hash.veritysetup", "fec.veritysetup"} {
+		require.NoError(t, os.WriteFile(dir+"/"+f, nil, 0o600))
+	}
+	salt, err := randomHex(32)
+	require.NoError(t, err)
+
+	v, err := devmapper.FormatVerity(devmapper.VerityTable{
+		HashType:   1,
+		DataDevice: dir + "/data",
+		HashDevice: dir + "/hash",
+		Salt:       salt,
+		FECDevice:  dir + "/fec",
+		FECRoots:   3,
+	}, devmapper.VerityFormatOptions{})
+	require.NoError(t, err)
+
+	out, err := exec.Command("veritysetup", "format", "--no-superblock", "--salt", salt, "--fec-device", dir+"/fec.veritysetup", "--fec-roots", "3", dir+"/data", dir+"/hash.veritysetup").Output()
+	require.NoError(t, err)
+	props, err := parseProperties(out)
+	require.NoError(t, err)
+	require.Equal(t, props["Root hash"], v.Digest)
+
+	// parity data must be identical to what veritysetup produces
+	got, err := os.ReadFile(dir + "/fec")
+	require.NoError(t, err)
+	expected, err := os.ReadFile(dir + "/fec.veritysetup")
+	require.NoError(t, err)
+	require.Equal(t, expected, got)
+
+	// wipe out a data block, kernel corrects it using FEC
+	corrupted := append([]byte(nil), data...)
+	copy(corrupted[5*4096:6*4096], make([]byte, 4096))
+	require.NoError(t, os.WriteFile(dir+"/data", corrupted, 0o600))
+
+	dLoop, err := losetup.Attach(dir+"/data", 0, true)
+	require.NoError(t, err)
+	defer dLoop.Detach()
+	hLoop, err := losetup.Attach(dir+"/hash", 0, true)
+	require.NoError(t, err)
+	defer hLoop.Detach()
+	fLoop, err := losetup.Attach(dir+"/fec", 0, true)
+	require.NoError(t, err)
+	defer fLoop.Detach()
+
+	uv := v
+	v.DataDevice, v.HashDevice, v.FECDevice = dLoop.Path(), hLoop.Path(), fLoop.Path()
+	name := "test.verity.fec"
+	require.NoError(t, devmapper.CreateAndLoad(name, "", devmapper.ReadOnlyFlag, v))
+	defer devmapper.Remove(name)
+
+	mapper := "/dev/mapper/" + name
+	require.NoError(t, waitForFile(mapper))
+	fromKernel, err := os.ReadFile(mapper)
+	require.NoError(t, err)
+	require.Equal(t, data, fromKernel)
+
+	status, err := devmapper.Status(name)
+	require.NoError(t, err)
+	parsed, err := status[0].Parse()
+	require.NoError(t, err)
+	require.NotZero(t, parsed.(*devmapper.VerityStatus).FECCorrected)
+
+	// the same correction in userspace
+	vol, err := devmapper.OpenUserspaceVolume(os.O_RDONLY, 0, uv)
+	require.NoError(t, err)
+	defer vol.Close()
+	buf := make([]byte, len(data))
+	_, err = vol.ReadAt(buf, 0)
+	require.NoError(t, err)
+	require.Equal(t, data, buf)
 }
@@ -2,7 +2,6 @@ package devmapper
 
 import (
 	"fmt"
-	"os"
 	"syscall"
 	"unsafe"
 
@@ -10,41 +9,15 @@ import (
 )
 
 // ioctlTable executes a device mapper ioctl with a set of table specs passed as a payload.
-// udevEvent is a boolean field that sets DM_UDEV_PRIMARY_SOURCE_FLAG udev flag.
-// This flag is later processed by rules at /usr/lib/udev/rules.d/10-dm.rules
-// Per devicecrypt sourcecode only RESUME, REMOVE, RENAME operations need to have DM_UDEV_PRIMARY_SOURCE_FLAG
-// flag set.
-func ioctlTable(cmd uintptr, name string, uuid string, flags uint32, primaryUdevEvent bool, tables []Table) error {
-	const (
-		// allocate buffer large enough for dmioctl + specs
-		alignment = 8
-
-		DM_UDEV_FLAGS_SHIFT = 16
-		// Quoting https://fossies.org/linux/LVM2/libdm/libdevmapper.h
-		//
-		// DM_UDEV_PRIMARY_SOURCE_FLAG is automatically appended by
-		// libdevmapper for all ioctls generating udev uevents. Once used in
-		// udev rules, we know if this is a real "primary sourced" event or not.
-		// We need to distinguish real events originated in libdevmapper from
-		// any spurious events to gather all missing information (e.g. events
-		// generated as a result of "udevadm trigger" command or as a result
-		// of the "watch" udev rule).
-		DM_UDEV_PRIMARY_SOURCE_FLAG = 0x0040
-	)
-
-	var udevFlags uint32
-	if primaryUdevEvent {
-		// device mapper has a complex initialization sequence. A device need to be 1) created
-		// 2) load table 3) resumed. The device is usable at the 3rd step only.
-		// To make udev rules handle the device at 3rd step (rather than at ADD event), device mapper distinguishes
-		// the "primary" events with a udev flag set below.
-		// Only RESUME, REMOVE, RENAME operations are considered primary events.
-		udevFlags = DM_UDEV_PRIMARY_SOURCE_FLAG << DM_UDEV_FLAGS_SHIFT
-	}
+// primaryUdevEvent is a boolean field that sets DM_UDEV_PRIMARY_SOURCE_FLAG udev flag and synchronizes
+// with udev, see ioctlUdev.
+func (c *Client) ioctlTable(cmd uintptr, name string, uuid string, flags uint32, primaryUdevEvent bool, tables []Table) error {
+	// allocate buffer large enough for dmioctl + specs
+	const alignment = 8
 
 	specs := make([]string, 0, len(tables)) // cached specs
 
-	length := unix.SizeofDmIoctl
+	var length int
 	for _, t := range tables {
 		length += unix.SizeofDmTargetSpec
 		spec := t.buildSpec()
@@ -53,51 +26,111 @@ func ioctlTable(cmd uintptr, name string, uuid string, flags uint32, primaryUdev
 		length += roundUp(len(spec)+1, alignment) // adding 1 for terminating NUL, then align the data
 	}
 
-	data := make([]byte, length)
+	payload := make([]byte, length)
 	var idx uintptr
-	ioctlData := (*unix.DmIoctl)(unsafe.Pointer(&data[0]))
-	ioctlData.Version = [...]uint32{4, 0, 0} // minimum required version
-	copy(ioctlData.Name[:], name)
-	copy(ioctlData.Uuid[:], uuid)
-	ioctlData.Data_size = uint32(length)
-	ioctlData.Data_start = unix.SizeofDmIoctl
-	ioctlData.Target_count = uint32(len(tables))
-	ioctlData.Flags = flags
-	ioctlData.Event_nr = udevFlags
-	idx += unix.SizeofDmIoctl
-
 	for i, t := range tables {
 		spec := specs[i]
 
-		specData := (*unix.DmTargetSpec)(unsafe.Pointer(&data[idx]))
+		specData := (*unix.DmTargetSpec)(unsafe.Pointer(&payload[idx]))
 		specSize := unix.SizeofDmTargetSpec + uintptr(roundUp(len(spec)+1, alignment))
 		specData.Next = uint32(specSize)
 		specData.Sector_start = t.start() / SectorSize
 		specData.Length = t.length() / SectorSize
 		copy(specData.Target_type[:], t.targetType())
-		copy(data[idx+unix.SizeofDmTargetSpec:], spec)
+		copy(payload[idx+unix.SizeofDmTargetSpec:], spec)
 
 		idx += specSize
 	}
 
-	return ioctl(cmd, data)
+	if primaryUdevEvent {
+		return c.ioctlUdev(cmd, name, flags, payload)
+	}
+	_, err := c.ioctlPayload(cmd, name, uuid, flags, 0, uint32(len(tables)), payload)
+	return err
 }
 
-func ioctl(cmd uintptr, data []byte) error {
-	controlFile, err := os.Open("/dev/mapper/control")
-	if err != nil {
-		return err
+// ioctlPayload executes a device mapper ioctl with an arbitrary payload placed right after the dm_ioctl header.
+// eventNr is passed as dm_ioctl.event_nr, for commands that generate uevents it carries the udev flags.
+// It returns the dm_ioctl header updated by the kernel.
+func (c *Client) ioctlPayload(cmd uintptr, name string, uuid string, flags uint32, eventNr uint32, targetCount uint32, payload []byte) (*unix.DmIoctl, error) {
+	length := unix.SizeofDmIoctl + len(payload)
+	data := make([]byte, length)
+	ioctlData := (*unix.DmIoctl)(unsafe.Pointer(&data[0]))
+	ioctlData.Version = [...]uint32{4, 0, 0} // minimum required version
+	copy(ioctlData.Name[:], name)
+	copy(ioctlData.Uuid[:], uuid)
+	ioctlData.Data_size = uint32(length)
+	ioctlData.Data_start = unix.SizeofDmIoctl
+	ioctlData.Target_count = targetCount
+	ioctlData.Flags = flags
+	ioctlData.Event_nr = eventNr
+	copy(data[unix.SizeofDmIoctl:], payload)
+
+	if err := c.ioctl(cmd, data); err != nil {
+		return nil, err
 	}
-	defer controlFile.Close()
+	return ioctlData, nil
+}
 
+// ioctlFd executes a device mapper ioctl using the given control file descriptor
+func ioctlFd(fd uintptr, cmd uintptr, data []byte) error {
 	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL,
-		controlFile.Fd(),
+		fd,
 		cmd,
 		uintptr(unsafe.Pointer(&data[0])),
 	)
 	if errno != 0 {
-		return os.NewSyscallError(fmt.Sprintf("dm ioctl (cmd=0x%x)", cmd), errno)
+		return errno
 	}
 
 	return nil
 }
+
+// ioctlWithOutput executes a device mapper ioctl that returns data back to the caller.
+// payload is copied right after the dm_ioctl header. If the kernel reports that the output does not fit into
+// the buffer then the request is retried with a bigger buffer.
+// eventNr is passed as dm_ioctl.event_nr.
+// It returns the dm_ioctl header and the data written by the kernel.
+func (c *Client) ioctlWithOutput(cmd uintptr, name string, uuid string, flags uint32, eventNr uint32, payload []byte) (*unix.DmIoctl, []byte, error) {
+	const maxBufferSize = 1024 * 1024 // 1 MB
+
+	bufferSize := 4096
+	for bufferSize < unix.SizeofDmIoctl+len(payload) {
+		bufferSize *= 4
+	}
+
+	for {
+		data := make([]byte, bufferSize)
+		ioctlData := (*unix.DmIoctl)(unsafe.Pointer(&data[0]))
+		ioctlData.Version = [...]uint32{4, 0, 0} // minimum required version
+		copy(ioctlData.Name[:], name)
+		copy(ioctlData.Uuid[:], uuid)
+		ioctlData.Data_size = uint32(bufferSize)
+		ioctlData.Data_start = unix.SizeofDmIoctl
+		ioctlData.Flags = flags
+		ioctlData.Event_nr = eventNr
+		copy(data[unix.SizeofDmIoctl:], payload)
+
+		if err := c.ioctl(cmd, data); err != nil {
+			return nil, nil, err
+		}
+
+		if ioctlData.Flags&unix.DM_BUFFER_FULL_FLAG != 0 {
+			if bufferSize >= maxBufferSize {
+				return nil, nil, fmt.Errorf("dm ioctl %s: output data is too big", cmdName(cmd))
+			}
+			bufferSize *= 4
+			continue // retry with bigger buffer
+		}
+
+		start, end := ioctlData.Data_start, ioctlData.Data_size
+		if end > uint32(bufferSize) {
+			return nil, nil, fmt.Errorf("dm ioctl %s: invalid output data range [%d, %d)", cmdName(cmd), start, end)
+		}
+		if start >= end {
+			// kernel resets data_size to the header size if the command produced no output
+			return ioctlData, nil, nil
+		}
+		return ioctlData, data[start:end], nil
+	}
+}
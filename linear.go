@@ -32,6 +32,23 @@ func (l LinearTable) buildSpec() string {
 	return strings.Join(args, " ")
 }
 
+func parseLinearTable(start, length uint64, params string) (Table, error) {
+	fields, err := splitParams(params, 2)
+	if err != nil {
+		return nil, err
+	}
+	offset, err := strconv.ParseUint(fields[1], 10, 64)
+	if err != nil {
+		return nil, err
+	}
+	return LinearTable{
+		Start:         start,
+		Length:        length,
+		BackendDevice: fields[0],
+		BackendOffset: offset * SectorSize,
+	}, nil
+}
+
 type linearVolume struct {
 	f      *os.File
 	offset int64
@@ -0,0 +1,8 @@
+//go:build 386 || arm || mips || mipsle || ppc
+
+package devmapper
+
+import "golang.org/x/sys/unix"
+
+// 32-bit architectures use semtimedop_time64 that takes struct __kernel_timespec with 64-bit fields
+const sysSemtimedop = unix.SYS_SEMTIMEDOP_TIME64
@@ -0,0 +1,7 @@
+//go:build amd64 || arm64 || loong64 || mips64 || mips64le || ppc64 || ppc64le || riscv64 || s390x || sparc64
+
+package devmapper
+
+import "golang.org/x/sys/unix"
+
+const sysSemtimedop = unix.SYS_SEMTIMEDOP
@@ -0,0 +1,276 @@
+package devmapper
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// TargetStatus represents status of a single target of a device, as reported by 'dmsetup status'
+type TargetStatus struct {
+	Start  uint64 // in bytes
+	Length uint64 // in bytes
+	Type   string // target type e.g. 'crypt' or 'verity'
+	Status string // raw status string reported by the target
+}
+
+// StatusParser converts target's raw status string into a typed value
+type StatusParser func(status string) (any, error)
+
+var (
+	statusParsersLock sync.RWMutex
+	statusParsers     = map[string]StatusParser{
+		"crypt":     parseCryptStatus,
+		"verity":    parseVerityStatus,
+		"snapshot":  parseSnapshotStatus,
+		"thin":      parseThinStatus,
+		"thin-pool": parseThinPoolStatus,
+		"raid":      parseRaidStatus,
+	}
+)
+
+// RegisterStatusParser registers a parser for status of the given target type.
+// It replaces a parser previously registered for this target type.
+func RegisterStatusParser(targetType string, parser StatusParser) {
+	statusParsersLock.Lock()
+	defer statusParsersLock.Unlock()
+	statusParsers[targetType] = parser
+}
+
+// Parse converts the raw status into a typed value e.g. *VerityStatus for 'verity' target.
+// It returns an error if there is no parser registered for the target type.
+func (s TargetStatus) Parse() (any, error) {
+	statusParsersLock.RLock()
+	parser, ok := statusParsers[s.Type]
+	statusParsersLock.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("no status parser registered for target type '%s'", s.Type)
+	}
+	return parser(s.Status)
+}
+
+// Status is a wrapper around Client.Status that uses the default client.
+func Status(name string) ([]TargetStatus, error) {
+	return defaultClient.Status(name)
+}
+
+// Status returns status of each target of the device's live table
+func (c *Client) Status(name string) ([]TargetStatus, error) {
+	return c.tableStatus(name, 0)
+}
+
+// tableStatus executes DM_TABLE_STATUS and returns per-target output. Depending on flags the output
+// contains either targets status or targets table (DM_STATUS_TABLE_FLAG).
+func (c *Client) tableStatus(name string, flags uint32) ([]TargetStatus, error) {
+	ioctlData, out, err := c.ioctlWithOutput(unix.DM_TABLE_STATUS, name, "", flags, 0, nil)
+	if err != nil {
+		return nil, err
+	}
+	return parseTargetStatus(ioctlData.Target_count, out)
+}
+
+// parseTargetStatus parses a list of dm_target_spec structures each followed by a NUL-terminated string
+// as returned by DM_TABLE_STATUS and DM_DEV_WAIT
+func parseTargetStatus(targetCount uint32, out []byte) ([]TargetStatus, error) {
+	result := make([]TargetStatus, 0, targetCount)
+	var offset uint32 // spec.Next is an offset relative to the beginning of the output data
+	for i := uint32(0); i < targetCount; i++ {
+		if int(offset)+unix.SizeofDmTargetSpec > len(out) {
+			return nil, fmt.Errorf("target status output data is truncated")
+		}
+		spec := (*unix.DmTargetSpec)(unsafe.Pointer(&out[offset]))
+		status := TargetStatus{
+			Start:  spec.Sector_start * SectorSize,
+			Length: spec.Length * SectorSize,
+			Type:   fixedArrayToString(spec.Target_type[:]),
+			Status: fixedArrayToString(out[int(offset)+unix.SizeofDmTargetSpec:]),
+		}
+		result = append(result, status)
+		offset = spec.Next
+	}
+
+	return result, nil
+}
+
+// SnapshotStatus represents status of 'snapshot' target
+type SnapshotStatus struct {
+	Invalid          bool // snapshot is invalidated e.g. it ran out of space
+	MergeFailed      bool
+	Overflow         bool
+	AllocatedSectors uint64
+	TotalSectors     uint64
+	MetadataSectors  uint64
+}
+
+func parseSnapshotStatus(status string) (any, error) {
+	switch status {
+	case "Invalid":
+		return &SnapshotStatus{Invalid: true}, nil
+	case "Merge failed":
+		return &SnapshotStatus{MergeFailed: true}, nil
+	case "Overflow":
+		return &SnapshotStatus{Overflow: true}, nil
+	}
+
+	fields := strings.Fields(status)
+	if len(fields) != 2 {
+		return nil, fmt.Errorf("invalid snapshot status '%s'", status)
+	}
+	allocated, total, err := parseRatio(fields[0])
+	if err != nil {
+		return nil, err
+	}
+	metadata, err := strconv.ParseUint(fields[1], 10, 64)
+	if err != nil {
+		return nil, err
+	}
+	return &SnapshotStatus{AllocatedSectors: allocated, TotalSectors: total, MetadataSectors: metadata}, nil
+}
+
+// ThinStatus represents status of 'thin' target
+type ThinStatus struct {
+	Failed              bool
+	MappedSectors       uint64
+	HighestMappedSector uint64
+	HasMappedSectors    bool // false if nothing is mapped yet and HighestMappedSector is undefined
+}
+
+func parseThinStatus(status string) (any, error) {
+	if status == "Fail" {
+		return &ThinStatus{Failed: true}, nil
+	}
+
+	fields := strings.Fields(status)
+	if len(fields) != 2 {
+		return nil, fmt.Errorf("invalid thin status '%s'", status)
+	}
+	mapped, err := strconv.ParseUint(fields[0], 10, 64)
+	if err != nil {
+		return nil, err
+	}
+	s := ThinStatus{MappedSectors: mapped}
+	if fields[1] != "-" {
+		s.HighestMappedSector, err = strconv.ParseUint(fields[1], 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		s.HasMappedSectors = true
+	}
+	return &s, nil
+}
+
+// ThinPoolStatus represents status of 'thin-pool' target
+type ThinPoolStatus struct {
+	Failed              bool
+	TransactionID       uint64
+	UsedMetadataBlocks  uint64
+	TotalMetadataBlocks uint64
+	UsedDataBlocks      uint64
+	TotalDataBlocks     uint64
+	HeldMetadataRoot    string // '-' if there is no held root
+	Mode                string // 'rw', 'ro' or 'out_of_data_space'
+	NeedsCheck          bool
+}
+
+func parseThinPoolStatus(status string) (any, error) {
+	if status == "Fail" {
+		return &ThinPoolStatus{Failed: true}, nil
+	}
+
+	fields := strings.Fields(status)
+	if len(fields) < 5 {
+		return nil, fmt.Errorf("invalid thin-pool status '%s'", status)
+	}
+	transactionID, err := strconv.ParseUint(fields[0], 10, 64)
+	if err != nil {
+		return nil, err
+	}
+	usedMetadata, totalMetadata, err := parseRatio(fields[1])
+	if err != nil {
+		return nil, err
+	}
+	usedData, totalData, err := parseRatio(fields[2])
+	if err != nil {
+		return nil, err
+	}
+	s := ThinPoolStatus{
+		TransactionID:       transactionID,
+		UsedMetadataBlocks:  usedMetadata,
+		TotalMetadataBlocks: totalMetadata,
+		UsedDataBlocks:      usedData,
+		TotalDataBlocks:     totalData,
+		HeldMetadataRoot:    fields[3],
+		Mode:                fields[4],
+	}
+	for _, f := range fields[5:] {
+		if f == "needs_check" {
+			s.NeedsCheck = true
+		}
+	}
+	return &s, nil
+}
+
+// RaidStatus represents status of 'raid' target
+type RaidStatus struct {
+	RaidType      string
+	NumDevices    int
+	Health        string // per-device health characters: 'A' alive and in-sync, 'a' alive but not in-sync, 'D' dead/failed
+	SyncedSectors uint64
+	TotalSectors  uint64
+	SyncAction    string // e.g. 'idle', 'resync', 'recover'
+	MismatchCount uint64
+}
+
+// Degraded returns true if any of the raid devices failed
+func (r RaidStatus) Degraded() bool {
+	return strings.ContainsRune(r.Health, 'D')
+}
+
+func parseRaidStatus(status string) (any, error) {
+	fields := strings.Fields(status)
+	if len(fields) < 6 {
+		return nil, fmt.Errorf("invalid raid status '%s'", status)
+	}
+	numDevices, err := strconv.Atoi(fields[1])
+	if err != nil {
+		return nil, err
+	}
+	synced, total, err := parseRatio(fields[3])
+	if err != nil {
+		return nil, err
+	}
+	mismatch, err := strconv.ParseUint(fields[5], 10, 64)
+	if err != nil {
+		return nil, err
+	}
+	return &RaidStatus{
+		RaidType:      fields[0],
+		NumDevices:    numDevices,
+		Health:        fields[2],
+		SyncedSectors: synced,
+		TotalSectors:  total,
+		SyncAction:    fields[4],
+		MismatchCount: mismatch,
+	}, nil
+}
+
+// parseRatio parses status values in form of "<used>/<total>"
+func parseRatio(s string) (uint64, uint64, error) {
+	a, b, ok := strings.Cut(s, "/")
+	if !ok {
+		return 0, 0, fmt.Errorf("invalid ratio value '%s'", s)
+	}
+	used, err := strconv.ParseUint(a, 10, 64)
+	if err != nil {
+		return 0, 0, err
+	}
+	total, err := strconv.ParseUint(b, 10, 64)
+	if err != nil {
+		return 0, 0, err
+	}
+	return used, total, nil
+}
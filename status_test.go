@@ -0,0 +1,60 @@
+package devmapper
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseStatus(t *testing.T) {
+	t.Parallel()
+
+	check := func(targetType, status string, expected any) {
+		got, err := TargetStatus{Type: targetType, Status: status}.Parse()
+		require.NoError(t, err)
+		require.Equal(t, expected, got)
+	}
+
+	check("verity", "V", &VerityStatus{})
+	check("verity", "C", &VerityStatus{Corrupted: true})
+	check("verity", "C 5", &VerityStatus{Corrupted: true, FECCorrected: 5})
+	check("crypt", "", &CryptStatus{})
+	check("snapshot", "16/2048 16", &SnapshotStatus{AllocatedSectors: 16, TotalSectors: 2048, MetadataSectors: 16})
+	check("snapshot", "Invalid", &SnapshotStatus{Invalid: true})
+	check("thin", "Fail", &ThinStatus{Failed: true})
+	check("thin", "0 -", &ThinStatus{})
+	check("thin", "2048 4095", &ThinStatus{MappedSectors: 2048, HighestMappedSector: 4095, HasMappedSectors: true})
+	check("thin-pool", "3 141/4161600 0/163840 - rw discard_passdown queue_if_no_space - 1024", &ThinPoolStatus{
+		TransactionID:       3,
+		UsedMetadataBlocks:  141,
+		TotalMetadataBlocks: 4161600,
+		UsedDataBlocks:      0,
+		TotalDataBlocks:     163840,
+		HeldMetadataRoot:    "-",
+		Mode:                "rw",
+	})
+	check("raid", "raid1 2 AD 1024/2048 recover 0 0 -", &RaidStatus{
+		RaidType:      "raid1",
+		NumDevices:    2,
+		Health:        "AD",
+		SyncedSectors: 1024,
+		TotalSectors:  2048,
+		SyncAction:    "recover",
+	})
+
+	_, err := TargetStatus{Type: "verity", Status: "X"}.Parse()
+	require.Error(t, err)
+	_, err = TargetStatus{Type: "unknown-target", Status: ""}.Parse()
+	require.Error(t, err)
+}
+
+func TestRegisterStatusParser(t *testing.T) {
+	type delayStatus struct{ raw string }
+	RegisterStatusParser("test-delay", func(status string) (any, error) {
+		return delayStatus{raw: status}, nil
+	})
+
+	got, err := TargetStatus{Type: "test-delay", Status: "0 0"}.Parse()
+	require.NoError(t, err)
+	require.Equal(t, delayStatus{raw: "0 0"}, got)
+}
@@ -0,0 +1,151 @@
+package devmapper
+
+import (
+	"fmt"
+	"io/fs"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// RawTable represents a target of any type with the specs passed to the kernel as is.
+// It allows to load targets that are not modelled by this package, e.g. 'error', 'delay' or 'striped'.
+// Tables() returns RawTable for targets of such types.
+type RawTable struct {
+	Start  uint64
+	Length uint64
+	Type   string
+	Params string // target parameters as specified in the kernel documentation, e.g. for 'linear' it is "/dev/loop0 0"
+}
+
+func (r RawTable) start() uint64 {
+	return r.Start
+}
+
+func (r RawTable) length() uint64 {
+	return r.Length
+}
+
+func (r RawTable) targetType() string {
+	return r.Type
+}
+
+func (r RawTable) buildSpec() string {
+	return r.Params
+}
+
+func (r RawTable) openVolume(flag int, perm fs.FileMode) (Volume, error) {
+	return nil, fmt.Errorf("userspace volume is not supported for target type '%s'", r.Type)
+}
+
+// CustomTarget is an extension interface that allows packages outside of devmapper to define their own table types.
+// Use NewCustomTable to convert it into a Table that can be passed to Load or CreateAndLoad.
+// If the target also implements VolumeOpener then it can be used with OpenUserspaceVolume.
+type CustomTarget interface {
+	Range() (start, length uint64) // in bytes
+	TargetType() string
+	BuildSpec() string // target parameters as specified in the kernel documentation
+}
+
+// VolumeOpener is an optional interface for CustomTarget that provides userspace access to the target data.
+type VolumeOpener interface {
+	OpenVolume(flag int, perm fs.FileMode) (Volume, error)
+}
+
+// NewCustomTable wraps a custom target into a Table
+func NewCustomTable(t CustomTarget) Table {
+	return customTable{t}
+}
+
+type customTable struct {
+	target CustomTarget
+}
+
+func (c customTable) start() uint64 {
+	start, _ := c.target.Range()
+	return start
+}
+
+func (c customTable) length() uint64 {
+	_, length := c.target.Range()
+	return length
+}
+
+func (c customTable) targetType() string {
+	return c.target.TargetType()
+}
+
+func (c customTable) buildSpec() string {
+	return c.target.BuildSpec()
+}
+
+func (c customTable) openVolume(flag int, perm fs.FileMode) (Volume, error) {
+	opener, ok := c.target.(VolumeOpener)
+	if !ok {
+		return nil, fmt.Errorf("userspace volume is not supported for target type '%s'", c.target.TargetType())
+	}
+	return opener.OpenVolume(flag, perm)
+}
+
+// tableParsers convert table spec (the output of buildSpec()) back to a typed table
+var tableParsers = map[string]func(start, length uint64, params string) (Table, error){
+	"linear": parseLinearTable,
+	"crypt":  parseCryptTable,
+	"verity": parseVerityTable,
+	"zero":   parseZeroTable,
+}
+
+// Tables is a wrapper around Client.Tables that uses the default client.
+func Tables(name string, inactive bool) ([]Table, error) {
+	return defaultClient.Tables(name, inactive)
+}
+
+// Tables reads the tables of the device back from the kernel. If inactive is true then
+// the inactive table (loaded but not yet resumed) is returned, otherwise the live table.
+// Targets modelled by this package are returned as LinearTable, CryptTable, VerityTable and ZeroTable,
+// all other targets are returned as RawTable.
+// Note that the kernel reports the underlying devices in "major:minor" format rather than a file path.
+func (c *Client) Tables(name string, inactive bool) ([]Table, error) {
+	// the table contains crypt keys, ask kernel to wipe its buffers
+	flags := uint32(unix.DM_STATUS_TABLE_FLAG | unix.DM_SECURE_DATA_FLAG)
+	if inactive {
+		flags |= unix.DM_QUERY_INACTIVE_TABLE_FLAG
+	}
+	specs, err := c.tableStatus(name, flags)
+	if err != nil {
+		return nil, err
+	}
+
+	tables := make([]Table, 0, len(specs))
+	for _, s := range specs {
+		t, err := parseTable(s.Type, s.Start, s.Length, s.Status)
+		if err != nil {
+			return nil, err
+		}
+		tables = append(tables, t)
+	}
+	dropMissingKeys(c.keyring(), tables)
+	return tables, nil
+}
+
+func parseTable(targetType string, start, length uint64, params string) (Table, error) {
+	parser, ok := tableParsers[targetType]
+	if !ok {
+		return RawTable{Start: start, Length: length, Type: targetType, Params: params}, nil
+	}
+	t, err := parser(start, length, params)
+	if err != nil {
+		// the params are not included into the error, e.g. crypt params contain the key
+		return nil, fmt.Errorf("invalid %s table: %v", targetType, err)
+	}
+	return t, nil
+}
+
+// splitParams splits table params into fields and checks that there are at least min fields
+func splitParams(params string, min int) ([]string, error) {
+	fields := strings.Fields(params)
+	if len(fields) < min {
+		return nil, fmt.Errorf("expected at least %d fields, got %d", min, len(fields))
+	}
+	return fields, nil
+}
@@ -0,0 +1,146 @@
+package devmapper
+
+import (
+	"os"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseTable(t *testing.T) {
+	t.Parallel()
+
+	// table spec parsing is inverse of buildSpec()
+	check := func(table Table) {
+		got, err := parseTable(table.targetType(), table.start(), table.length(), table.buildSpec())
+		require.NoError(t, err)
+		require.Equal(t, table, got)
+	}
+
+	check(LinearTable{Start: 1024, Length: 4096, BackendDevice: "7:0", BackendOffset: 2048})
+	check(ZeroTable{Start: 0, Length: 8192})
+	check(CryptTable{
+		Length:        8192,
+		BackendDevice: "7:1",
+		BackendOffset: 4096,
+		Encryption:    "aes-xts-plain64",
+		Key:           []byte{1, 2, 3, 4, 5, 6, 7, 8},
+		IVTweak:       5,
+		Flags:         []string{CryptFlagAllowDiscards, CryptFlagNoReadWorkqueue},
+		SectorSize:    4096,
+	})
+	check(CryptTable{
+		Length:        8192,
+		BackendDevice: "7:1",
+		Encryption:    "aes-xts-plain64",
+		KeyID:         ":32:logon:foobarkey",
+	})
+	check(VerityTable{
+		Length:           4096 * 512,
+		HashType:         1,
+		DataDevice:       "7:2",
+		HashDevice:       "7:3",
+		DataBlockSize:    4096,
+		HashBlockSize:    4096,
+		NumDataBlocks:    512,
+		HashStartBlock:   1,
+		Algorithm:        "sha256",
+		Digest:           "4392712ba01368efdf14b05c76f9e4df0d53664630b5d48632ed17a137f39076",
+		Salt:             "-",
+		IgnoreZeroBlocks: true,
+	})
+	check(VerityTable{
+		Length:             4096 * 512,
+		HashType:           1,
+		DataDevice:         "7:2",
+		HashDevice:         "7:3",
+		DataBlockSize:      4096,
+		HashBlockSize:      4096,
+		NumDataBlocks:      512,
+		HashStartBlock:     1,
+		Algorithm:          "sha256",
+		Digest:             "4392712ba01368efdf14b05c76f9e4df0d53664630b5d48632ed17a137f39076",
+		Salt:               "-",
+		CorruptionMode:     VerityCorruptionRestart,
+		CheckAtMostOnce:    true,
+		FECDevice:          "7:4",
+		FECRoots:           2,
+		FECBlocks:          514,
+		FECStart:           0,
+		RootHashSigKeyDesc: "verity:root",
+		Params:             []string{"try_verify_in_tasklet"},
+	})
+	check(RawTable{Length: 4096, Type: "delay", Params: "7:0 0 500"})
+
+	_, err := parseTable("linear", 0, 4096, "7:0")
+	require.Error(t, err)
+	_, err = parseTable("crypt", 0, 4096, "aes-xts-plain64 - 0 7:0 0 2 allow_discards")
+	require.Error(t, err)
+	// the key must not leak into the error message
+	const key = "603deb1015ca71be2b73aef0857d77811f352c073b6108d72d9810a30914dff4"
+	_, err = parseTable("crypt", 0, 4096, "aes-xts-plain64 "+key+" iv 7:0 0")
+	require.Error(t, err)
+	require.NotContains(t, err.Error(), key)
+	_, err = parseTable("crypt", 0, 4096, "aes-xts-plain64 "+key+"x 0 7:0 0")
+	require.Error(t, err)
+	require.NotContains(t, err.Error(), key)
+	_, err = parseTable("verity", 0, 4096, "1 7:2 7:3 4096 4096 1 1 sha256 00 - 2 ignore_zero_blocks")
+	require.Error(t, err)
+	_, err = parseTable("verity", 0, 4096, "1 7:2 7:3 4096 4096 1 1 sha256 00 - 1 fec_roots")
+	require.Error(t, err)
+}
+
+type delayTarget struct {
+	start, length uint64
+	device        string
+	delayMs       int
+}
+
+func (d delayTarget) Range() (uint64, uint64) {
+	return d.start, d.length
+}
+
+func (d delayTarget) TargetType() string {
+	return "delay"
+}
+
+func (d delayTarget) BuildSpec() string {
+	return d.device + " 0 " + strconv.Itoa(d.delayMs)
+}
+
+func TestCustomTable(t *testing.T) {
+	t.Parallel()
+
+	table := NewCustomTable(delayTarget{start: 512, length: 4096, device: "7:0", delayMs: 500})
+	require.Equal(t, uint64(512), table.start())
+	require.Equal(t, uint64(4096), table.length())
+	require.Equal(t, "delay", table.targetType())
+	require.Equal(t, "7:0 0 500", table.buildSpec())
+
+	_, err := table.openVolume(os.O_RDONLY, 0)
+	require.Error(t, err, "delayTarget does not implement VolumeOpener")
+}
+
+func TestVerityTableParams(t *testing.T) {
+	t.Parallel()
+
+	v := VerityTable{
+		HashType:      1,
+		DataDevice:    "7:2",
+		HashDevice:    "7:3",
+		DataBlockSize: 4096,
+		HashBlockSize: 4096,
+		NumDataBlocks: 512,
+		Algorithm:     "sha256",
+		Digest:        "00",
+		Salt:          "-",
+	}
+	const prefix = "1 7:2 7:3 4096 4096 512 0 sha256 00 -"
+
+	v.Params = []string{"try_verify_in_tasklet"}
+	require.Equal(t, prefix+" 1 try_verify_in_tasklet", v.buildSpec())
+
+	v.CheckAtMostOnce = true
+	require.Equal(t, prefix+" 2 check_at_most_once try_verify_in_tasklet", v.buildSpec(), "the count covers the typed options and params")
+}
@@ -0,0 +1,280 @@
+package devmapper
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// DeviceNode is a block device in the device mapper topology graph
+type DeviceNode struct {
+	DevNo   uint64
+	Name    string        // device mapper name, or kernel name (e.g. 'loop0', 'sdb1') for non device mapper devices
+	Info    *DeviceInfo   // nil for non device mapper devices
+	Deps    []*DeviceNode // devices this device is stacked on top of
+	Holders []*DeviceNode // device mapper devices stacked on top of this device
+}
+
+// IsMapper returns true if the node is a device mapper device
+func (n *DeviceNode) IsMapper() bool {
+	return n.Info != nil
+}
+
+// DeviceGraph is a DAG of stacked block devices, e.g. verity on top of crypt on top of linear on top of loop
+type DeviceGraph struct {
+	Nodes map[uint64]*DeviceNode // indexed by device number
+}
+
+// Topology is a wrapper around Client.Topology that uses the default client.
+func Topology() (*DeviceGraph, error) {
+	return defaultClient.Topology()
+}
+
+// Topology builds a graph of all device mapper devices and the block devices they depend on
+func (c *Client) Topology() (*DeviceGraph, error) {
+	list, err := c.List()
+	if err != nil {
+		return nil, err
+	}
+
+	infos := make([]*DeviceInfo, 0, len(list))
+	deps := make(map[uint64][]uint64, len(list))
+	for _, l := range list {
+		// the device might have been removed after the list was taken
+		info, err := c.InfoByDevno(l.DevNo)
+		if errors.Is(err, ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		d, err := c.Deps(info.Name)
+		if errors.Is(err, ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		infos = append(infos, info)
+		deps[info.DevNo] = d
+	}
+
+	return newDeviceGraph(infos, deps, blockDeviceName), nil
+}
+
+// newDeviceGraph builds a graph from the device mapper devices info and their dependencies.
+// nameOf is used to resolve names of non device mapper devices.
+func newDeviceGraph(infos []*DeviceInfo, deps map[uint64][]uint64, nameOf func(devno uint64) string) *DeviceGraph {
+	g := &DeviceGraph{Nodes: make(map[uint64]*DeviceNode)}
+	for _, info := range infos {
+		g.Nodes[info.DevNo] = &DeviceNode{DevNo: info.DevNo, Name: info.Name, Info: info}
+	}
+
+	for _, info := range infos {
+		node := g.Nodes[info.DevNo]
+		for _, d := range deps[info.DevNo] {
+			dep, ok := g.Nodes[d]
+			if !ok {
+				dep = &DeviceNode{DevNo: d, Name: nameOf(d)}
+				g.Nodes[d] = dep
+			}
+			node.Deps = append(node.Deps, dep)
+			dep.Holders = append(dep.Holders, node)
+		}
+	}
+
+	for _, n := range g.Nodes {
+		sortNodes(n.Deps)
+		sortNodes(n.Holders)
+	}
+	return g
+}
+
+// Node returns a graph node by its device number, nil if the device is not part of the graph
+func (g *DeviceGraph) Node(devno uint64) *DeviceNode {
+	return g.Nodes[devno]
+}
+
+// Roots returns device mapper devices that have no other device mapper devices on top of them
+func (g *DeviceGraph) Roots() []*DeviceNode {
+	var roots []*DeviceNode
+	for _, n := range g.Nodes {
+		if n.IsMapper() && len(n.Holders) == 0 {
+			roots = append(roots, n)
+		}
+	}
+	sortNodes(roots)
+	return roots
+}
+
+// HoldersOf returns all device mapper devices that sit (directly or transitively) on top of the given device.
+// The devices are returned in top-down order, i.e. a device always precedes the devices it depends on.
+func (g *DeviceGraph) HoldersOf(devno uint64) []*DeviceNode {
+	node := g.Nodes[devno]
+	if node == nil {
+		return nil
+	}
+
+	var result []*DeviceNode
+	visited := make(map[uint64]bool)
+	var visit func(n *DeviceNode)
+	visit = func(n *DeviceNode) {
+		for _, h := range n.Holders {
+			if visited[h.DevNo] {
+				continue
+			}
+			visited[h.DevNo] = true
+			visit(h) // a device is added only after all devices on top of it
+			result = append(result, h)
+		}
+	}
+	visit(node)
+	return result
+}
+
+// String prints the graph in 'dmsetup ls --tree' format
+func (g *DeviceGraph) String() string {
+	var sb strings.Builder
+	var print func(n *DeviceNode, prefix string)
+	print = func(n *DeviceNode, prefix string) {
+		for i, d := range n.Deps {
+			branch, indent := " ├─", " │ "
+			if i == len(n.Deps)-1 {
+				branch, indent = " └─", "   "
+			}
+			fmt.Fprintf(&sb, "%s%s%s\n", prefix, branch, d.label())
+			print(d, prefix+indent)
+		}
+	}
+
+	for _, r := range g.Roots() {
+		sb.WriteString(r.label() + "\n")
+		print(r, "")
+	}
+	return sb.String()
+}
+
+func (n *DeviceNode) label() string {
+	devno := fmt.Sprintf("(%d:%d)", unix.Major(n.DevNo), unix.Minor(n.DevNo))
+	if n.Name == "" {
+		return devno
+	}
+	return n.Name + " " + devno
+}
+
+func sortNodes(nodes []*DeviceNode) {
+	sort.Slice(nodes, func(i, j int) bool {
+		if nodes[i].Name != nodes[j].Name {
+			return nodes[i].Name < nodes[j].Name
+		}
+		return nodes[i].DevNo < nodes[j].DevNo
+	})
+}
+
+// blockDeviceName resolves kernel name of a block device using sysfs, an empty string is returned if it fails
+func blockDeviceName(devno uint64) string {
+	link, err := os.Readlink(fmt.Sprintf("/sys/dev/block/%d:%d", unix.Major(devno), unix.Minor(devno)))
+	if err != nil {
+		return ""
+	}
+	return filepath.Base(link)
+}
+
+// RemoveTreeOptions controls RemoveTree behavior
+type RemoveTreeOptions struct {
+	DryRun bool // do not remove anything, only report the devices that would be removed
+}
+
+// RemoveTree is a wrapper around Client.RemoveTree that uses the default client.
+func RemoveTree(name string, opts RemoveTreeOptions) ([]string, error) {
+	return defaultClient.RemoveTree(name, opts)
+}
+
+// RemoveTree removes the device and every device mapper device below it in top-down order, e.g. for
+// verity on top of crypt on top of linear all three devices are removed.
+// Lower devices that are still held open by anything else (another device mapper device, a mounted
+// filesystem, a process) are skipped together with the devices below them. If the top device itself is held
+// open then ErrBusy is returned, in dry-run mode too.
+// It returns names of the removed devices, in dry-run mode names of the devices that would be removed.
+func (c *Client) RemoveTree(name string, opts RemoveTreeOptions) ([]string, error) {
+	list, err := c.List()
+	if err != nil {
+		return nil, err
+	}
+	mapperNames := make(map[uint64]string, len(list))
+	for _, l := range list {
+		mapperNames[l.DevNo] = l.Name
+	}
+
+	infos := make(map[string]*DeviceInfo)
+	deps := make(map[string][]string) // device mapper devices each device depends on
+	var order []string
+	var visit func(name string) error
+	visit = func(name string) error {
+		info, err := c.InfoByName(name)
+		if err != nil {
+			return err
+		}
+		infos[name] = info
+
+		devs, err := c.Deps(name)
+		if err != nil {
+			return err
+		}
+		for _, d := range devs {
+			depName, ok := mapperNames[d]
+			if !ok {
+				continue // not a device mapper device, e.g. a loop device or a disk partition
+			}
+			deps[name] = append(deps[name], depName)
+			if _, visited := infos[depName]; !visited {
+				if err := visit(depName); err != nil {
+					return err
+				}
+			}
+		}
+		order = append(order, name) // a device is added only after all devices below it
+		return nil
+	}
+	if err := visit(name); err != nil {
+		return nil, err
+	}
+
+	removedHolders := make(map[string]int32) // number of removed devices that were holding a device open
+	removed := make([]string, 0, len(order))
+	for i := len(order) - 1; i >= 0; i-- {
+		n := order[i]
+		openCount := infos[n].OpenCount - removedHolders[n]
+		if !opts.DryRun && n != name {
+			info, err := c.InfoByName(n)
+			if err != nil {
+				return removed, err
+			}
+			openCount = info.OpenCount
+		}
+		if openCount > 0 {
+			if n == name {
+				return removed, fmt.Errorf("%s: %w", name, ErrBusy)
+			}
+			continue // the device is used by someone else
+		}
+
+		if !opts.DryRun {
+			if err := c.Remove(n); err != nil {
+				return removed, err
+			}
+		}
+		removed = append(removed, n)
+		for _, d := range deps[n] {
+			removedHolders[d]++
+		}
+	}
+
+	return removed, nil
+}
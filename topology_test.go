@@ -0,0 +1,56 @@
+package devmapper
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sys/unix"
+)
+
+func TestDeviceGraph(t *testing.T) {
+	t.Parallel()
+
+	loop0 := unix.Mkdev(7, 0)
+	loop1 := unix.Mkdev(7, 1)
+	linear := &DeviceInfo{Name: "linear", DevNo: unix.Mkdev(253, 0)}
+	crypt := &DeviceInfo{Name: "crypt", DevNo: unix.Mkdev(253, 1)}
+	verity := &DeviceInfo{Name: "verity", DevNo: unix.Mkdev(253, 2)}
+	zero := &DeviceInfo{Name: "zero", DevNo: unix.Mkdev(253, 3)}
+
+	deps := map[uint64][]uint64{
+		linear.DevNo: {loop0},
+		crypt.DevNo:  {linear.DevNo},
+		verity.DevNo: {crypt.DevNo, loop1},
+	}
+	names := map[uint64]string{loop0: "loop0"}
+	g := newDeviceGraph([]*DeviceInfo{linear, crypt, verity, zero}, deps, func(devno uint64) string {
+		return names[devno]
+	})
+
+	require.Len(t, g.Nodes, 6)
+	require.False(t, g.Node(loop0).IsMapper())
+	require.True(t, g.Node(linear.DevNo).IsMapper())
+
+	roots := g.Roots()
+	require.Len(t, roots, 2)
+	require.Equal(t, "verity", roots[0].Name)
+	require.Equal(t, "zero", roots[1].Name)
+
+	holders := g.HoldersOf(loop0)
+	require.Len(t, holders, 3)
+	require.Equal(t, "verity", holders[0].Name)
+	require.Equal(t, "crypt", holders[1].Name)
+	require.Equal(t, "linear", holders[2].Name)
+
+	require.Empty(t, g.HoldersOf(verity.DevNo))
+	require.Nil(t, g.HoldersOf(unix.Mkdev(8, 16)))
+
+	expected := `verity (253:2)
+ ├─(7:1)
+ └─crypt (253:1)
+    └─linear (253:0)
+       └─loop0 (7:0)
+zero (253:3)
+`
+	require.Equal(t, expected, g.String())
+}
@@ -0,0 +1,266 @@
+package devmapper
+
+import (
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"os"
+	"path/filepath"
+	"time"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// Quoting https://fossies.org/linux/LVM2/libdm/libdevmapper.h
+// Udev flags are passed to the kernel in the upper 16 bits of dm_ioctl.event_nr, the kernel puts them into
+// the DM_COOKIE uevent variable that is later processed by rules at /usr/lib/udev/rules.d/10-dm.rules
+const (
+	udevFlagsShift = 16
+
+	// DM_UDEV_DISABLE_DM_RULES_FLAG is set in case we need to disable basic device-mapper udev rules
+	// that create symlinks in /dev/<DM_DIR> directory.
+	udevDisableDMRulesFlag = 0x0001
+	// DM_UDEV_DISABLE_SUBSYSTEM_RULES_FLAG is set in case we need to disable subsystem udev rules,
+	// but still we need the general DM udev rules to be applied (to create the nodes and symlinks
+	// under /dev and /dev/disk).
+	udevDisableSubsystemRulesFlag = 0x0002
+	// DM_UDEV_PRIMARY_SOURCE_FLAG is automatically appended by
+	// libdevmapper for all ioctls generating udev uevents. Once used in
+	// udev rules, we know if this is a real "primary sourced" event or not.
+	// We need to distinguish real events originated in libdevmapper from
+	// any spurious events to gather all missing information (e.g. events
+	// generated as a result of "udevadm trigger" command or as a result
+	// of the "watch" udev rule).
+	udevPrimarySourceFlag = 0x0040
+
+	// cookieMagic is the upper part of the SysV semaphore key, the lower 16 bits are the cookie itself.
+	// The same value is used by libdevmapper and 'dmsetup udevcomplete'.
+	cookieMagic = 0x0D4D
+
+	udevControl     = "/run/udev/control" // exists if udev daemon is running
+	udevWaitTimeout = 30 * time.Second
+	mapperDir       = "/dev/mapper"
+)
+
+// UdevSync defines how a client makes sure that /dev/mapper nodes are ready once an operation returns.
+// It applies to the operations that generate udev events: Resume (and CreateAndLoad), Remove and Rename.
+type UdevSync int
+
+const (
+	// UdevSyncNone does not wait for udev, the device nodes appear asynchronously some time after the
+	// operation returns. This is the default.
+	UdevSyncNone UdevSync = iota
+	// UdevSyncCookie waits until udev finishes processing the device events. It uses libdevmapper-compatible
+	// SysV semaphore cookies and needs udev rules shipped with libdevmapper (95-dm-notify.rules) that
+	// release the cookie with 'dmsetup udevcomplete'. If udev is not running then UdevSyncMknod is used instead.
+	UdevSyncCookie
+	// UdevSyncMknod disables the device mapper udev rules and creates, renames and removes /dev/mapper
+	// nodes directly with mknod, e.g. in an initramfs without udev.
+	UdevSyncMknod
+)
+
+// SetUdevSync is a wrapper around Client.SetUdevSync that uses the default client.
+func SetUdevSync(mode UdevSync) {
+	defaultClient.SetUdevSync(mode)
+}
+
+// SetUdevSync sets the udev synchronization mode of the client. It is ignored by clients that use a custom transport.
+func (c *Client) SetUdevSync(mode UdevSync) {
+	c.udevSync.Store(int32(mode))
+}
+
+// udevSyncMode returns the mode to be used for the next operation
+func (c *Client) udevSyncMode() UdevSync {
+	if c.controlPath == "" {
+		return UdevSyncNone // custom transports do not create kernel devices
+	}
+	mode := UdevSync(c.udevSync.Load())
+	if mode == UdevSyncCookie && !udevRunning() {
+		mode = UdevSyncMknod
+	}
+	return mode
+}
+
+func udevRunning() bool {
+	_, err := os.Stat(udevControl)
+	return err == nil
+}
+
+// ioctlUdev executes a device mapper ioctl that generates a primary udev event (resume, remove, rename)
+// and synchronizes /dev/mapper nodes according to the client udev sync mode.
+func (c *Client) ioctlUdev(cmd uintptr, name string, flags uint32, payload []byte) error {
+	// device mapper has a complex initialization sequence. A device need to be 1) created
+	// 2) load table 3) resumed. The device is usable at the 3rd step only.
+	// To make udev rules handle the device at 3rd step (rather than at ADD event), device mapper distinguishes
+	// the "primary" events with a udev flag set below.
+	// Only RESUME, REMOVE, RENAME operations are considered primary events.
+	udevFlags := uint32(udevPrimarySourceFlag)
+
+	mode := c.udevSyncMode()
+	var cookie *udevCookie
+	switch mode {
+	case UdevSyncCookie:
+		var err error
+		cookie, err = newUdevCookie()
+		if err != nil {
+			return err
+		}
+		defer cookie.destroy()
+	case UdevSyncMknod:
+		udevFlags |= udevDisableDMRulesFlag | udevDisableSubsystemRulesFlag
+	}
+
+	eventNr := udevFlags << udevFlagsShift
+	if cookie != nil {
+		eventNr |= uint32(cookie.id)
+	}
+	ioctlData, err := c.ioctlPayload(cmd, name, "", flags, eventNr, 0, payload)
+	if err != nil {
+		return err
+	}
+
+	switch mode {
+	case UdevSyncCookie:
+		if ioctlData.Flags&unix.DM_UEVENT_GENERATED_FLAG == 0 {
+			return nil // no uevent means that udev is not going to release the cookie
+		}
+		if err := cookie.wait(udevWaitTimeout); err != nil {
+			return fmt.Errorf("%s: %v", name, err)
+		}
+	case UdevSyncMknod:
+		return updateNodes(mapperDir, cmd, name, flags, ioctlData, payload)
+	}
+	return nil
+}
+
+// udevCookie is a SysV semaphore that udev rules decrement once they process the device uevent
+type udevCookie struct {
+	id    uint16 // lower 16 bits of the semaphore key, passed to the kernel in dm_ioctl.event_nr
+	semid int
+}
+
+// struct sembuf
+type sembuf struct {
+	num uint16
+	op  int16
+	flg int16
+}
+
+// struct __kernel_timespec, it is used by semtimedop on 64-bit architectures and semtimedop_time64 on 32-bit ones
+type timespec64 struct {
+	sec  int64
+	nsec int64
+}
+
+func cookieKey(id uint16) int {
+	return cookieMagic<<16 | int(id)
+}
+
+// newUdevCookie creates a semaphore with value 1 that udev is expected to decrement
+func newUdevCookie() (*udevCookie, error) {
+	const setval = 16 // SETVAL command of semctl
+
+	for {
+		id := uint16(rand.Uint32())
+		if id == 0 {
+			continue // zero cookie means no cookie
+		}
+		semid, _, errno := unix.Syscall(unix.SYS_SEMGET, uintptr(cookieKey(id)), 1, 0o600|unix.IPC_CREAT|unix.IPC_EXCL)
+		if errno == unix.EEXIST {
+			continue // the cookie is used by someone else
+		}
+		if errno != 0 {
+			return nil, os.NewSyscallError("semget", errno)
+		}
+
+		cookie := &udevCookie{id: id, semid: int(semid)}
+		if _, _, errno := unix.Syscall6(unix.SYS_SEMCTL, semid, 0, setval, 1, 0, 0); errno != 0 {
+			cookie.destroy()
+			return nil, os.NewSyscallError("semctl", errno)
+		}
+		return cookie, nil
+	}
+}
+
+// wait waits until the semaphore gets decremented to zero
+func (c *udevCookie) wait(timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		left := time.Until(deadline)
+		if left <= 0 {
+			return fmt.Errorf("timeout waiting for udev to process cookie 0x%x", c.id)
+		}
+		ts := timespec64{sec: int64(left / time.Second), nsec: int64(left % time.Second)}
+		op := sembuf{num: 0, op: 0, flg: 0} // wait for zero
+		_, _, errno := unix.Syscall6(sysSemtimedop, uintptr(c.semid), uintptr(unsafe.Pointer(&op)), 1, uintptr(unsafe.Pointer(&ts)), 0, 0)
+		switch errno {
+		case 0:
+			return nil
+		case unix.EINTR:
+			continue
+		case unix.EAGAIN:
+			return fmt.Errorf("timeout waiting for udev to process cookie 0x%x", c.id)
+		default:
+			return os.NewSyscallError("semtimedop", errno)
+		}
+	}
+}
+
+func (c *udevCookie) destroy() {
+	_, _, _ = unix.Syscall(unix.SYS_SEMCTL, uintptr(c.semid), 0, unix.IPC_RMID)
+}
+
+// updateNodes creates, renames or removes nodes at dir after a successful ioctl, the same as
+// libdevmapper does when udev rules are disabled
+func updateNodes(dir string, cmd uintptr, name string, flags uint32, ioctlData *unix.DmIoctl, payload []byte) error {
+	switch cmd {
+	case unix.DM_DEV_SUSPEND:
+		if ioctlData.Flags&unix.DM_SUSPEND_FLAG != 0 {
+			return nil
+		}
+		return createNode(dir, fixedArrayToString(ioctlData.Name[:]), ioctlData.Dev)
+	case unix.DM_DEV_REMOVE:
+		if ioctlData.Flags&unix.DM_DEFERRED_REMOVE != 0 {
+			return nil // the device is still open and will be removed later by the kernel
+		}
+		if err := os.Remove(filepath.Join(dir, name)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	case unix.DM_DEV_RENAME:
+		if flags&unix.DM_UUID_FLAG != 0 {
+			return nil
+		}
+		newName := fixedArrayToString(payload)
+		if err := os.Rename(filepath.Join(dir, name), filepath.Join(dir, newName)); err != nil {
+			if !errors.Is(err, os.ErrNotExist) {
+				return err
+			}
+			return createNode(dir, newName, ioctlData.Dev)
+		}
+	}
+	return nil
+}
+
+// createNode creates a block device node for the device, an existing node is replaced if it points to another device
+func createNode(dir string, name string, devno uint64) error {
+	path := filepath.Join(dir, name)
+
+	var st unix.Stat_t
+	if err := unix.Stat(path, &st); err == nil {
+		if st.Mode&unix.S_IFMT == unix.S_IFBLK && uint64(st.Rdev) == devno {
+			return nil
+		}
+		if err := os.Remove(path); err != nil {
+			return err
+		}
+	}
+
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+	if err := unix.Mknod(path, unix.S_IFBLK|0o600, int(devno)); err != nil {
+		return &os.PathError{Op: "mknod", Path: path, Err: err}
+	}
+	return nil
+}
@@ -0,0 +1,90 @@
+package devmapper
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+	"unsafe"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sys/unix"
+)
+
+// udevComplete decrements the cookie semaphore the same way 'dmsetup udevcomplete <cookie>' does
+func udevComplete(cookie uint32) error {
+	semid, _, errno := unix.Syscall(unix.SYS_SEMGET, uintptr(cookieKey(uint16(cookie))), 1, 0)
+	if errno != 0 {
+		return errno
+	}
+	op := sembuf{num: 0, op: -1, flg: unix.IPC_NOWAIT}
+	if _, _, errno := unix.Syscall6(sysSemtimedop, semid, uintptr(unsafe.Pointer(&op)), 1, 0, 0, 0); errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+func TestUdevCookie(t *testing.T) {
+	t.Parallel()
+
+	cookie, err := newUdevCookie()
+	require.NoError(t, err)
+	defer cookie.destroy()
+	require.NotZero(t, cookie.id)
+
+	// udev gets the cookie with the udev flags from DM_COOKIE uevent variable
+	eventNr := udevPrimarySourceFlag<<udevFlagsShift | uint32(cookie.id)
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		_ = udevComplete(eventNr)
+	}()
+	require.NoError(t, cookie.wait(5*time.Second))
+
+	other, err := newUdevCookie()
+	require.NoError(t, err)
+	require.ErrorContains(t, other.wait(10*time.Millisecond), "timeout waiting for udev")
+
+	other.destroy()
+	require.Error(t, udevComplete(uint32(other.id)), "the cookie is destroyed")
+}
+
+func TestUpdateNodes(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	devno := unix.Mkdev(253, 7)
+
+	ioctlData := &unix.DmIoctl{Dev: devno}
+	copy(ioctlData.Name[:], "test")
+	if err := updateNodes(dir, unix.DM_DEV_SUSPEND, "test", 0, ioctlData, nil); err != nil {
+		if errors.Is(err, unix.EPERM) {
+			t.Skip("mknod requires CAP_MKNOD")
+		}
+		require.NoError(t, err)
+	}
+	checkNode := func(name string) {
+		var st unix.Stat_t
+		require.NoError(t, unix.Stat(filepath.Join(dir, name), &st))
+		require.Equal(t, uint32(unix.S_IFBLK), st.Mode&unix.S_IFMT)
+		require.Equal(t, devno, uint64(st.Rdev))
+	}
+	checkNode("test")
+
+	// the node is kept when the device is suspended
+	ioctlData.Flags = unix.DM_SUSPEND_FLAG
+	require.NoError(t, updateNodes(dir, unix.DM_DEV_SUSPEND, "test", 0, ioctlData, nil))
+	checkNode("test")
+
+	require.NoError(t, updateNodes(dir, unix.DM_DEV_RENAME, "test", unix.DM_UUID_FLAG, ioctlData, []byte("uuid\x00")))
+	checkNode("test")
+	require.NoError(t, updateNodes(dir, unix.DM_DEV_RENAME, "test", 0, ioctlData, []byte("renamed\x00")))
+	require.NoFileExists(t, filepath.Join(dir, "test"))
+	checkNode("renamed")
+
+	ioctlData.Flags = unix.DM_DEFERRED_REMOVE
+	require.NoError(t, updateNodes(dir, unix.DM_DEV_REMOVE, "renamed", 0, ioctlData, nil))
+	checkNode("renamed")
+	ioctlData.Flags = 0
+	require.NoError(t, updateNodes(dir, unix.DM_DEV_REMOVE, "renamed", 0, ioctlData, nil))
+	require.NoFileExists(t, filepath.Join(dir, "renamed"))
+}
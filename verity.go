@@ -1,9 +1,34 @@
 package devmapper
 
 import (
+	"bytes"
+	"crypto"
+	_ "crypto/sha1" // register hash algorithms supported by dm-verity
+	_ "crypto/sha256"
+	_ "crypto/sha512"
+	"encoding/hex"
+	"fmt"
+	"io"
 	"io/fs"
+	"math/bits"
+	"os"
 	"strconv"
 	"strings"
+	"sync"
+)
+
+// VerityCorruptionMode defines how dm-verity handles a corrupted block
+type VerityCorruptionMode string
+
+const (
+	// VerityCorruptionEIO is the default mode, reading a corrupted block returns EIO
+	VerityCorruptionEIO VerityCorruptionMode = ""
+	// VerityCorruptionIgnore is an equivalent of 'ignore_corruption' verity option, corruption is only logged
+	VerityCorruptionIgnore VerityCorruptionMode = "ignore_corruption"
+	// VerityCorruptionRestart is an equivalent of 'restart_on_corruption' verity option, the system is restarted
+	VerityCorruptionRestart VerityCorruptionMode = "restart_on_corruption"
+	// VerityCorruptionPanic is an equivalent of 'panic_on_corruption' verity option, the kernel panics
+	VerityCorruptionPanic VerityCorruptionMode = "panic_on_corruption"
 )
 
 // VerityTable represents information needed for 'verity' target creation
@@ -16,7 +41,28 @@ type VerityTable struct {
 	DataBlockSize, HashBlockSize  uint64
 	NumDataBlocks, HashStartBlock uint64
 	Algorithm, Digest, Salt       string
-	Params                        []string
+
+	CorruptionMode   VerityCorruptionMode
+	IgnoreZeroBlocks bool // do not verify blocks that are expected to contain zeroes and always return zeroes instead
+	CheckAtMostOnce  bool // verify data blocks only the first time they are read
+
+	// forward error correction, enabled if FECDevice is set
+	FECDevice string // device that supplies the FEC parity data, it can be the same as HashDevice
+	FECRoots  uint64 // number of generator roots, i.e. parity bytes per Reed-Solomon codeword
+	FECBlocks uint64 // number of blocks covered by FEC, in DataBlockSize blocks
+	FECStart  uint64 // offset of the FEC parity data on FECDevice, in DataBlockSize blocks
+
+	RootHashSigKeyDesc string // description of the keyring key that holds the root hash PKCS#7 signature
+	// RootHashSig is PKCS#7 detached signature of the root hash. If it is set then the signature is added to
+	// the process keyring for the time of the table load and RootHashSigKeyDesc refers to it. An empty
+	// RootHashSigKeyDesc means an auto-generated description, a key with the given description must not exist.
+	// Tables reports RootHashSigKeyDesc only while the key exists, so a table read back after the key is
+	// unlinked loads without the signature unless RootHashSig is set again.
+	RootHashSig []byte
+	// Params are other optional parameters passed to the target after the options above, e.g.
+	// []string{"try_verify_in_tasklet"}. Params must not include the number of the optional parameters,
+	// it is always computed by the library.
+	Params []string
 }
 
 func (v VerityTable) start() uint64 {
@@ -38,24 +84,456 @@ func (v VerityTable) buildSpec() string {
 		strconv.FormatUint(v.HashStartBlock, 10), v.Algorithm, v.Digest, v.Salt,
 	}
 
-	args = append(args, v.Params...)
+	opts := v.optionalParams()
+	if len(opts) > 0 {
+		args = append(args, strconv.Itoa(len(opts)))
+		args = append(args, opts...)
+	}
 	return strings.Join(args, " ")
 }
 
-type verityVolume struct{}
+// optionalParams returns the optional target parameters in the same order the kernel reports them
+func (v VerityTable) optionalParams() []string {
+	var opts []string
+	if v.CorruptionMode != VerityCorruptionEIO {
+		opts = append(opts, string(v.CorruptionMode))
+	}
+	if v.IgnoreZeroBlocks {
+		opts = append(opts, "ignore_zero_blocks")
+	}
+	if v.CheckAtMostOnce {
+		opts = append(opts, "check_at_most_once")
+	}
+	if v.FECDevice != "" {
+		opts = append(opts,
+			"use_fec_from_device", v.FECDevice,
+			"fec_roots", strconv.FormatUint(v.FECRoots, 10),
+			"fec_blocks", strconv.FormatUint(v.FECBlocks, 10),
+			"fec_start", strconv.FormatUint(v.FECStart, 10),
+		)
+	}
+	if v.RootHashSigKeyDesc != "" {
+		opts = append(opts, "root_hash_sig_key_desc", v.RootHashSigKeyDesc)
+	}
+	return append(opts, v.Params...)
+}
+
+func parseVerityTable(start, length uint64, params string) (Table, error) {
+	fields, err := splitParams(params, 10)
+	if err != nil {
+		return nil, err
+	}
+
+	nums := make([]uint64, 0, 5)
+	for _, f := range []string{fields[0], fields[3], fields[4], fields[5], fields[6]} {
+		n, err := strconv.ParseUint(f, 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		nums = append(nums, n)
+	}
+
+	v := VerityTable{
+		Start:          start,
+		Length:         length,
+		HashType:       nums[0],
+		DataDevice:     fields[1],
+		HashDevice:     fields[2],
+		DataBlockSize:  nums[1],
+		HashBlockSize:  nums[2],
+		NumDataBlocks:  nums[3],
+		HashStartBlock: nums[4],
+		Algorithm:      fields[7],
+		Digest:         fields[8],
+		Salt:           fields[9],
+	}
+	if len(fields) > 10 {
+		num, err := strconv.Atoi(fields[10])
+		if err != nil {
+			return nil, err
+		}
+		if num != len(fields)-11 {
+			return nil, fmt.Errorf("expected %d optional parameters, got %d", num, len(fields)-11)
+		}
+		if err := v.parseOptionalParams(fields[11:]); err != nil {
+			return nil, err
+		}
+	}
+	return v, nil
+}
+
+func (v *VerityTable) parseOptionalParams(opts []string) error {
+	// value returns the argument of the option at position i
+	value := func(i int) (string, error) {
+		if i+1 >= len(opts) {
+			return "", fmt.Errorf("verity option '%s' requires an argument", opts[i])
+		}
+		return opts[i+1], nil
+	}
+	number := func(i int, dst *uint64) error {
+		arg, err := value(i)
+		if err != nil {
+			return err
+		}
+		*dst, err = strconv.ParseUint(arg, 10, 64)
+		return err
+	}
+
+	for i := 0; i < len(opts); i++ {
+		var err error
+		switch opt := opts[i]; opt {
+		case string(VerityCorruptionIgnore), string(VerityCorruptionRestart), string(VerityCorruptionPanic):
+			v.CorruptionMode = VerityCorruptionMode(opt)
+			continue
+		case "ignore_zero_blocks":
+			v.IgnoreZeroBlocks = true
+			continue
+		case "check_at_most_once":
+			v.CheckAtMostOnce = true
+			continue
+		case "use_fec_from_device":
+			v.FECDevice, err = value(i)
+		case "fec_roots":
+			err = number(i, &v.FECRoots)
+		case "fec_blocks":
+			err = number(i, &v.FECBlocks)
+		case "fec_start":
+			err = number(i, &v.FECStart)
+		case "root_hash_sig_key_desc":
+			v.RootHashSigKeyDesc, err = value(i)
+		default:
+			v.Params = append(v.Params, opt)
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		i++ // skip the option argument
+	}
+	return nil
+}
+
+// VerityStatus represents status of 'verity' target
+type VerityStatus struct {
+	Corrupted    bool   // a corrupted block has been detected ('C' state)
+	FECCorrected uint64 // number of blocks corrected by forward error correction
+}
+
+func parseVerityStatus(status string) (any, error) {
+	fields := strings.Fields(status)
+	if len(fields) == 0 {
+		return nil, fmt.Errorf("invalid verity status '%s'", status)
+	}
+
+	var s VerityStatus
+	switch fields[0] {
+	case "V":
+	case "C":
+		s.Corrupted = true
+	default:
+		return nil, fmt.Errorf("invalid verity status '%s'", status)
+	}
+	if len(fields) > 1 && fields[1] != "-" {
+		corrected, err := strconv.ParseUint(fields[1], 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		s.FECCorrected = corrected
+	}
+	return &s, nil
+}
+
+// VerityCorruptionError is returned by the verity userspace volume when a block does not match the hash tree
+type VerityCorruptionError struct {
+	Device string // path of the device that contains the corrupted block, either DataDevice or HashDevice
+	Block  uint64 // index of the corrupted block, in DataBlockSize blocks for the data device and HashBlockSize blocks for the hash device
+}
+
+func (e *VerityCorruptionError) Error() string {
+	return fmt.Sprintf("verity: block %d of %s is corrupted", e.Block, e.Device)
+}
+
+// verityTree describes the layout of dm-verity hash tree, see drivers/md/dm-verity-target.c
+type verityTree struct {
+	hashType         uint64
+	hash             crypto.Hash
+	salt             []byte
+	dataBlockSize    uint64
+	hashBlockSize    uint64
+	dataBlocks       uint64
+	hashStart        uint64   // position of the first hash block
+	hashPerBlockBits uint     // log2 of the number of digests stored in a hash block
+	levelBlock       []uint64 // position of the first hash block of each level, level 0 is the lowest one
+}
+
+var verityAlgorithms = map[string]crypto.Hash{
+	"sha1":   crypto.SHA1,
+	"sha224": crypto.SHA224,
+	"sha256": crypto.SHA256,
+	"sha384": crypto.SHA384,
+	"sha512": crypto.SHA512,
+}
+
+func newVerityTree(v VerityTable) (*verityTree, error) {
+	if v.NumDataBlocks == 0 {
+		return nil, fmt.Errorf("verity table has no data blocks")
+	}
+	if v.HashType > 1 {
+		return nil, fmt.Errorf("unsupported verity hash type %d", v.HashType)
+	}
+	hash, ok := verityAlgorithms[v.Algorithm]
+	if !ok {
+		return nil, fmt.Errorf("unsupported verity hash algorithm '%s'", v.Algorithm)
+	}
+	for _, size := range []uint64{v.DataBlockSize, v.HashBlockSize} {
+		if size < SectorSize || size&(size-1) != 0 {
+			return nil, fmt.Errorf("verity block size %d must be a power of two and not smaller than devmapper.SectorSize", size)
+		}
+	}
+	if uint64(hash.Size()) > v.HashBlockSize/2 {
+		return nil, fmt.Errorf("verity hash block size %d is too small for %s", v.HashBlockSize, v.Algorithm)
+	}
+
+	var salt []byte
+	if v.Salt != "-" {
+		var err error
+		salt, err = hex.DecodeString(v.Salt)
+		if err != nil {
+			return nil, fmt.Errorf("invalid verity salt: %v", err)
+		}
+	}
+
+	t := &verityTree{
+		hashType:      v.HashType,
+		hash:          hash,
+		salt:          salt,
+		dataBlockSize: v.DataBlockSize,
+		hashBlockSize: v.HashBlockSize,
+		dataBlocks:    v.NumDataBlocks,
+		hashStart:     v.HashStartBlock,
+	}
+	// every digest occupies a power-of-two slot in a hash block
+	t.hashPerBlockBits = uint(bits.Len64(v.HashBlockSize/uint64(hash.Size())) - 1)
+
+	levels := 0
+	for t.hashPerBlockBits*uint(levels) < 64 && (t.dataBlocks-1)>>(t.hashPerBlockBits*uint(levels)) != 0 {
+		levels++
+	}
+	t.levelBlock = make([]uint64, levels)
+	position := v.HashStartBlock
+	for i := levels - 1; i >= 0; i-- {
+		t.levelBlock[i] = position
+		position += t.levelBlocks(i)
+	}
+	return t, nil
+}
+
+// levelBlocks returns the number of hash blocks at the given level
+func (t *verityTree) levelBlocks(level int) uint64 {
+	shift := uint(level+1) * t.hashPerBlockBits
+	if shift >= 64 {
+		return 1
+	}
+	return (t.dataBlocks + 1<<shift - 1) >> shift
+}
+
+// hashEnd returns the position of the first block after the hash tree
+func (t *verityTree) hashEnd() uint64 {
+	if len(t.levelBlock) == 0 {
+		return t.hashStart
+	}
+	return t.levelBlock[0] + t.levelBlocks(0)
+}
+
+// hashAt returns position of the hash block and the offset of the digest inside of it for the given data block at the given level
+func (t *verityTree) hashAt(block uint64, level int) (uint64, uint64) {
+	position := block >> (uint(level) * t.hashPerBlockBits)
+	hashBlock := t.levelBlock[level] + position>>t.hashPerBlockBits
+	offset := (position & (1<<t.hashPerBlockBits - 1)) * t.digestSlot()
+	return hashBlock, offset
+}
+
+// digestSlot returns the space used by a digest in a hash block, format version 0 packs the digests
+// while version 1 pads them to a power of two
+func (t *verityTree) digestSlot() uint64 {
+	if t.hashType == 0 {
+		return uint64(t.hash.Size())
+	}
+	return t.hashBlockSize >> t.hashPerBlockBits
+}
+
+// digest calculates a digest of the block, format version 1 prepends the salt while version 0 appends it
+func (t *verityTree) digest(block []byte) []byte {
+	h := t.hash.New()
+	if t.hashType == 1 {
+		h.Write(t.salt)
+	}
+	h.Write(block)
+	if t.hashType == 0 {
+		h.Write(t.salt)
+	}
+	return h.Sum(nil)
+}
+
+type verityVolume struct {
+	tree       *verityTree
+	root       []byte
+	data, hash *os.File
+	fec        *verityFEC // nil if forward error correction is not enabled
+	fecFile    *os.File
+	zeroDigest []byte // digest of a zero block if IgnoreZeroBlocks is set
+
+	mu       sync.Mutex
+	verified map[uint64][]byte // hash blocks that have been verified already
+}
 
 func (v VerityTable) openVolume(flag int, perm fs.FileMode) (Volume, error) {
-	return &verityVolume{}, nil
+	tree, err := newVerityTree(v)
+	if err != nil {
+		return nil, err
+	}
+	root, err := hex.DecodeString(v.Digest)
+	if err != nil {
+		return nil, fmt.Errorf("invalid verity root digest: %v", err)
+	}
+	if len(root) != tree.hash.Size() {
+		return nil, fmt.Errorf("verity root digest size does not match %s", v.Algorithm)
+	}
+
+	data, err := os.OpenFile(v.DataDevice, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	hash, err := os.OpenFile(v.HashDevice, flag, perm)
+	if err != nil {
+		data.Close()
+		return nil, err
+	}
+	vol := &verityVolume{tree: tree, root: root, data: data, hash: hash, verified: make(map[uint64][]byte)}
+	if v.IgnoreZeroBlocks {
+		vol.zeroDigest = tree.digest(make([]byte, tree.dataBlockSize))
+	}
+
+	if v.FECDevice != "" {
+		vol.fec, err = newVerityFEC(v, tree)
+		if err == nil {
+			vol.fecFile, err = os.OpenFile(v.FECDevice, flag, perm)
+		}
+		if err != nil {
+			vol.Close()
+			return nil, err
+		}
+	}
+	return vol, nil
 }
 
-func (v verityVolume) ReadAt(p []byte, off int64) (n int, err error) {
-	return 0, errNotImplemented
+func (v *verityVolume) ReadAt(buf []byte, off int64) (int, error) {
+	blockSize := v.tree.dataBlockSize
+	size := v.tree.dataBlocks * blockSize
+	offset := uint64(off)
+	if offset >= size {
+		return 0, io.EOF
+	}
+	end := min(offset+uint64(len(buf)), size)
+
+	block := make([]byte, blockSize)
+	read := 0
+	for b := offset / blockSize; b*blockSize < end; b++ {
+		if _, err := v.data.ReadAt(block, int64(b*blockSize)); err != nil {
+			return read, err
+		}
+		if err := v.verifyDataBlock(b, block); err != nil {
+			return read, err
+		}
+
+		// copy the requested part of the block
+		from := max(offset, b*blockSize)
+		to := min(end, (b+1)*blockSize)
+		read += copy(buf[from-offset:to-offset], block[from-b*blockSize:to-b*blockSize])
+	}
+	if read < len(buf) {
+		return read, io.EOF // the read is past the end of the data device
+	}
+	return read, nil
 }
 
-func (v verityVolume) WriteAt(p []byte, off int64) (n int, err error) {
-	return 0, errNotImplemented
+// verifyDataBlock checks the data block against the hash tree, starting from the root digest down to the lowest level
+func (v *verityVolume) verifyDataBlock(block uint64, data []byte) error {
+	want := v.root
+	for level := len(v.tree.levelBlock) - 1; level >= 0; level-- {
+		hashBlock, offset := v.tree.hashAt(block, level)
+		content, err := v.hashBlock(hashBlock, want)
+		if err != nil {
+			return err
+		}
+		want = content[offset : offset+uint64(v.tree.hash.Size())]
+	}
+
+	if v.zeroDigest != nil && bytes.Equal(want, v.zeroDigest) {
+		// like the kernel, a block expected to contain zeroes is not verified and reads as zeroes
+		clear(data)
+		return nil
+	}
+	if !bytes.Equal(v.tree.digest(data), want) {
+		corrected, ok := v.correct(block, want)
+		if !ok {
+			return &VerityCorruptionError{Device: v.data.Name(), Block: block}
+		}
+		copy(data, corrected)
+	}
+	return nil
 }
 
-func (v verityVolume) Close() error {
-	return errNotImplemented
+// correct tries to recover the block at the given position of the FEC area and checks it against the expected digest
+func (v *verityVolume) correct(position uint64, want []byte) ([]byte, bool) {
+	if v.fec == nil || position >= v.fec.blocks {
+		return nil, false
+	}
+	content, err := v.fec.decode(v.data, v.hash, v.fecFile, position)
+	if err != nil || !bytes.Equal(v.tree.digest(content), want) {
+		return nil, false
+	}
+	return content, true
+}
+
+// hashBlock reads the hash block and checks it against the digest from the upper level
+func (v *verityVolume) hashBlock(position uint64, want []byte) ([]byte, error) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	if content, ok := v.verified[position]; ok {
+		return content, nil
+	}
+
+	content := make([]byte, v.tree.hashBlockSize)
+	if _, err := v.hash.ReadAt(content, int64(position*v.tree.hashBlockSize)); err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(v.tree.digest(content), want) {
+		// hash blocks are covered by FEC right after the data blocks
+		corrected, ok := v.correct(v.tree.dataBlocks+position-v.tree.hashStart, want)
+		if !ok {
+			return nil, &VerityCorruptionError{Device: v.hash.Name(), Block: position}
+		}
+		content = corrected
+	}
+	v.verified[position] = content
+	return content, nil
+}
+
+func (v *verityVolume) WriteAt(buf []byte, off int64) (int, error) {
+	return 0, fmt.Errorf("verity volume is read-only")
+}
+
+func (v *verityVolume) Close() error {
+	err := v.data.Close()
+	if err2 := v.hash.Close(); err == nil {
+		err = err2
+	}
+	if v.fecFile != nil {
+		if err2 := v.fecFile.Close(); err == nil {
+			err = err2
+		}
+	}
+	return err
 }
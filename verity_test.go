@@ -0,0 +1,316 @@
+package devmapper
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestVerityUserspaceVolume(t *testing.T) {
+	t.Parallel()
+
+	const blockSize = 512
+	salt := []byte("salt")
+	digest := func(block []byte) []byte {
+		h := sha256.New()
+		h.Write(salt)
+		h.Write(block)
+		return h.Sum(nil)
+	}
+
+	// 4 data blocks fit into a single hash block, the root digest is the digest of that hash block
+	data := make([]byte, 4*blockSize)
+	for i := range data {
+		data[i] = byte(i / blockSize)
+	}
+	hashBlock := make([]byte, blockSize)
+	for i := 0; i < 4; i++ {
+		copy(hashBlock[i*sha256.Size:], digest(data[i*blockSize:(i+1)*blockSize]))
+	}
+	hash := append(make([]byte, blockSize), hashBlock...) // the hash tree starts at the 2nd block
+
+	dir := t.TempDir()
+	dataFile := filepath.Join(dir, "data")
+	hashFile := filepath.Join(dir, "hash")
+	require.NoError(t, os.WriteFile(dataFile, data, 0o600))
+	require.NoError(t, os.WriteFile(hashFile, hash, 0o600))
+
+	table := VerityTable{
+		Length:         uint64(len(data)),
+		HashType:       1,
+		DataDevice:     dataFile,
+		HashDevice:     hashFile,
+		DataBlockSize:  blockSize,
+		HashBlockSize:  blockSize,
+		NumDataBlocks:  4,
+		HashStartBlock: 1,
+		Algorithm:      "sha256",
+		Digest:         hex.EncodeToString(digest(hashBlock)),
+		Salt:           hex.EncodeToString(salt),
+	}
+
+	read := func() ([]byte, error) {
+		vol, err := OpenUserspaceVolume(os.O_RDONLY, 0, table)
+		require.NoError(t, err)
+		defer vol.Close()
+
+		buf := make([]byte, len(data))
+		_, err = vol.ReadAt(buf, 0)
+		return buf, err
+	}
+
+	buf, err := read()
+	require.NoError(t, err)
+	require.Equal(t, data, buf)
+
+	// corrupt the 3rd data block
+	corrupted := bytes.Clone(data)
+	corrupted[2*blockSize+10] ^= 1
+	require.NoError(t, os.WriteFile(dataFile, corrupted, 0o600))
+	_, err = read()
+	var corruption *VerityCorruptionError
+	require.True(t, errors.As(err, &corruption))
+	require.Equal(t, &VerityCorruptionError{Device: dataFile, Block: 2}, corruption)
+
+	// corrupt the hash block
+	require.NoError(t, os.WriteFile(dataFile, data, 0o600))
+	hash[blockSize+100] ^= 1
+	require.NoError(t, os.WriteFile(hashFile, hash, 0o600))
+	_, err = read()
+	require.True(t, errors.As(err, &corruption))
+	require.Equal(t, &VerityCorruptionError{Device: hashFile, Block: 1}, corruption)
+	hash[blockSize+100] ^= 1
+	require.NoError(t, os.WriteFile(hashFile, hash, 0o600))
+
+	// reads at the end follow io.ReaderAt contract
+	vol, err := table.openVolume(os.O_RDONLY, 0)
+	require.NoError(t, err)
+	defer vol.Close()
+	buf = make([]byte, 2*blockSize)
+	n, err := vol.ReadAt(buf, 3*blockSize)
+	require.Equal(t, io.EOF, err)
+	require.Equal(t, blockSize, n)
+	require.Equal(t, data[3*blockSize:], buf[:n])
+	n, err = vol.ReadAt(buf, int64(len(data)))
+	require.Equal(t, io.EOF, err)
+	require.Zero(t, n)
+	all, err := io.ReadAll(io.NewSectionReader(vol, 0, 1<<20))
+	require.NoError(t, err)
+	require.Equal(t, data, all)
+
+	// the 1st data block contains zeroes, with IgnoreZeroBlocks it is not verified and reads as zeroes
+	corrupted = bytes.Clone(data)
+	corrupted[10] = 1
+	require.NoError(t, os.WriteFile(dataFile, corrupted, 0o600))
+	_, err = read()
+	require.True(t, errors.As(err, &corruption))
+	require.Equal(t, &VerityCorruptionError{Device: dataFile, Block: 0}, corruption)
+	table.IgnoreZeroBlocks = true
+	buf, err = read()
+	require.NoError(t, err)
+	require.Equal(t, data, buf)
+}
+
+// format 0 packs 20-byte sha1 digests into the hash blocks without padding them to a power of two
+// and appends the salt, it is the layout produced by 'veritysetup format --format=0 --hash=sha1'
+func verityFormat0Tree(data []byte, blockSize int, salt []byte) (hash, root []byte) {
+	digest := func(block []byte) []byte {
+		h := sha1.New()
+		h.Write(block)
+		h.Write(salt)
+		return h.Sum(nil)
+	}
+	level := func(src []byte) []byte {
+		const perBlock = 16 // 512/20 digests rounded down to a power of two
+		blocks := len(src) / blockSize
+		out := make([]byte, (blocks+perBlock-1)/perBlock*blockSize)
+		for i := 0; i < blocks; i++ {
+			offset := i/perBlock*blockSize + i%perBlock*sha1.Size
+			copy(out[offset:], digest(src[i*blockSize:(i+1)*blockSize]))
+		}
+		return out
+	}
+
+	// the top level goes first on the hash device
+	level0 := level(data)
+	level1 := level(level0)
+	return append(level1, level0...), digest(level1)
+}
+
+func TestVerityFormat0(t *testing.T) {
+	t.Parallel()
+
+	const blockSize = 512
+	salt := []byte("salt")
+	data := make([]byte, 20*blockSize) // two levels, 16 digests per hash block
+	for i := range data {
+		data[i] = byte(i / blockSize)
+	}
+	hash, root := verityFormat0Tree(data, blockSize, salt)
+	require.Len(t, hash, 3*blockSize)
+
+	dir := t.TempDir()
+	dataFile := filepath.Join(dir, "data")
+	hashFile := filepath.Join(dir, "hash")
+	require.NoError(t, os.WriteFile(dataFile, data, 0o600))
+	require.NoError(t, os.WriteFile(hashFile, hash, 0o600))
+
+	table := VerityTable{
+		Length:        uint64(len(data)),
+		HashType:      0,
+		DataDevice:    dataFile,
+		HashDevice:    hashFile,
+		DataBlockSize: blockSize,
+		HashBlockSize: blockSize,
+		NumDataBlocks: 20,
+		Algorithm:     "sha1",
+		Digest:        hex.EncodeToString(root),
+		Salt:          hex.EncodeToString(salt),
+	}
+	vol, err := OpenUserspaceVolume(os.O_RDONLY, 0, table)
+	require.NoError(t, err)
+	defer vol.Close()
+	buf := make([]byte, len(data))
+	_, err = vol.ReadAt(buf, 0)
+	require.NoError(t, err)
+	require.Equal(t, data, buf)
+
+	// FormatVerity produces the same hash tree
+	formattedHashFile := filepath.Join(dir, "formatted")
+	require.NoError(t, os.WriteFile(formattedHashFile, nil, 0o600))
+	formatted, err := FormatVerity(VerityTable{
+		HashType:      0,
+		DataDevice:    dataFile,
+		HashDevice:    formattedHashFile,
+		DataBlockSize: blockSize,
+		HashBlockSize: blockSize,
+		Algorithm:     "sha1",
+		Salt:          table.Salt,
+	}, VerityFormatOptions{})
+	require.NoError(t, err)
+	require.Equal(t, table.Digest, formatted.Digest)
+	formattedHash, err := os.ReadFile(formattedHashFile)
+	require.NoError(t, err)
+	require.Equal(t, hash, formattedHash)
+}
+
+func TestFormatVerity(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name                         string
+		dataBlocks                   int
+		dataBlockSize, hashBlockSize uint64
+		hashType                     uint64
+		algorithm, salt              string
+		superblock                   bool
+	}{
+		{"single block", 1, 4096, 4096, 1, "sha256", "", false},
+		{"one level", 100, 4096, 4096, 1, "sha256", "", false},
+		{"three levels", 300, 512, 512, 1, "sha256", "00ff", true},
+		{"format 0", 300, 512, 1024, 0, "sha1", "abcdef", false},
+		{"no salt", 70, 1024, 512, 1, "sha512", "-", true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+
+			dir := t.TempDir()
+			dataFile := filepath.Join(dir, "data")
+			hashFile := filepath.Join(dir, "hash")
+			data := make([]byte, test.dataBlocks*int(test.dataBlockSize))
+			_, _ = rand.Read(data)
+			require.NoError(t, os.WriteFile(dataFile, data, 0o600))
+			require.NoError(t, os.WriteFile(hashFile, nil, 0o600))
+
+			table, err := FormatVerity(VerityTable{
+				HashType:      test.hashType,
+				DataDevice:    dataFile,
+				HashDevice:    hashFile,
+				DataBlockSize: test.dataBlockSize,
+				HashBlockSize: test.hashBlockSize,
+				Algorithm:     test.algorithm,
+				Salt:          test.salt,
+			}, VerityFormatOptions{Superblock: test.superblock})
+			require.NoError(t, err)
+			require.Equal(t, uint64(test.dataBlocks), table.NumDataBlocks)
+			require.Equal(t, uint64(len(data)), table.Length)
+			if test.superblock {
+				require.Equal(t, uint64(1), table.HashStartBlock)
+			}
+			if test.salt == "" {
+				require.Len(t, table.Salt, 64, "random salt")
+			}
+			if test.dataBlocks == 1 {
+				root := sha256.Sum256(append(mustDecodeHex(t, table.Salt), data...))
+				require.Equal(t, hex.EncodeToString(root[:]), table.Digest)
+			}
+
+			vol, err := OpenUserspaceVolume(os.O_RDONLY, 0, table)
+			require.NoError(t, err)
+			defer vol.Close()
+			buf := make([]byte, len(data))
+			_, err = vol.ReadAt(buf, 0)
+			require.NoError(t, err)
+			require.Equal(t, data, buf)
+
+			// corrupt the last data block
+			data[len(data)-1] ^= 1
+			require.NoError(t, os.WriteFile(dataFile, data, 0o600))
+			vol, err = OpenUserspaceVolume(os.O_RDONLY, 0, table)
+			require.NoError(t, err)
+			defer vol.Close()
+			_, err = vol.ReadAt(buf, 0)
+			require.Equal(t, &VerityCorruptionError{Device: dataFile, Block: uint64(test.dataBlocks - 1)}, err)
+		})
+	}
+}
+
+func mustDecodeHex(t *testing.T, s string) []byte {
+	b, err := hex.DecodeString(s)
+	require.NoError(t, err)
+	return b
+}
+
+func TestReadVeritySuperblock(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	dataFile := filepath.Join(dir, "data")
+	hashFile := filepath.Join(dir, "hash")
+	require.NoError(t, os.WriteFile(dataFile, make([]byte, 64*1024), 0o600))
+	require.NoError(t, os.WriteFile(hashFile, nil, 0o600))
+
+	formatted, err := FormatVerity(VerityTable{
+		HashType:       1,
+		DataDevice:     dataFile,
+		HashDevice:     hashFile,
+		DataBlockSize:  1024,
+		HashBlockSize:  512,
+		HashStartBlock: 2,
+		Algorithm:      "sha1",
+		Salt:           "0123456789",
+	}, VerityFormatOptions{Superblock: true, UUID: "79639465-407e-4af6-b76b-d98a70c0d5d3"})
+	require.NoError(t, err)
+
+	table, uuid, err := ReadVeritySuperblock(hashFile, 2*512)
+	require.NoError(t, err)
+	require.Equal(t, "79639465-407e-4af6-b76b-d98a70c0d5d3", uuid)
+	require.Empty(t, table.Digest)
+	table.DataDevice = dataFile
+	table.Digest = formatted.Digest
+	require.Equal(t, formatted, table)
+
+	_, _, err = ReadVeritySuperblock(hashFile, 0)
+	require.ErrorContains(t, err, "does not contain a verity superblock")
+}
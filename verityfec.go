@@ -0,0 +1,348 @@
+package devmapper
+
+import (
+	"fmt"
+	"io"
+	"os"
+)
+
+// dm-verity forward error correction uses RS(255, 255-roots) code over GF(2^8), see drivers/md/dm-verity-fec.c
+const (
+	fecRSM      = 255 // codeword size
+	fecMinRoots = 2
+	fecMaxRoots = 24
+	// generator polynomial of GF(2^8) used by the kernel, x^8 + x^4 + x^3 + x^2 + 1
+	fecGFPoly = 0x11d
+)
+
+var gfExp, gfLog = func() (exp [2 * fecRSM]byte, log [256]int) {
+	x := 1
+	for i := 0; i < fecRSM; i++ {
+		exp[i] = byte(x)
+		exp[i+fecRSM] = byte(x)
+		log[x] = i
+		x <<= 1
+		if x&0x100 != 0 {
+			x ^= fecGFPoly
+		}
+	}
+	return
+}()
+
+func gfMul(a, b byte) byte {
+	if a == 0 || b == 0 {
+		return 0
+	}
+	return gfExp[gfLog[a]+gfLog[b]]
+}
+
+func gfDiv(a, b byte) byte {
+	if a == 0 {
+		return 0
+	}
+	return gfExp[gfLog[a]+fecRSM-gfLog[b]]
+}
+
+// gfPow returns alpha^n
+func gfPow(n int) byte {
+	n %= fecRSM
+	if n < 0 {
+		n += fecRSM
+	}
+	return gfExp[n]
+}
+
+// polyEval evaluates polynomial with coefficients in ascending order at x
+func polyEval(p []byte, x byte) byte {
+	var y byte
+	for i := len(p) - 1; i >= 0; i-- {
+		y = gfMul(y, x) ^ p[i]
+	}
+	return y
+}
+
+// rsCodec is a Reed-Solomon codec compatible with the kernel lib/reed_solomon initialized with
+// init_rs(8, 0x11d, 0, 1, roots): the first consecutive root is alpha^0 and the primitive element is alpha^1.
+// The first symbol of a codeword is the coefficient of the highest power of x.
+type rsCodec struct {
+	roots   int
+	genpoly []byte // generator polynomial, ascending order, monic
+}
+
+func newRSCodec(roots int) *rsCodec {
+	// g(x) = (x - alpha^0)(x - alpha^1)...(x - alpha^(roots-1))
+	g := []byte{1}
+	for i := 0; i < roots; i++ {
+		next := make([]byte, len(g)+1)
+		for j, c := range g {
+			next[j+1] ^= c
+			next[j] ^= gfMul(c, gfPow(i))
+		}
+		g = next
+	}
+	return &rsCodec{roots: roots, genpoly: g}
+}
+
+// encode calculates the parity of the data, data has fecRSM-roots symbols
+func (rs *rsCodec) encode(data, parity []byte) {
+	clear(parity)
+	for _, d := range data {
+		feedback := d ^ parity[0]
+		copy(parity, parity[1:])
+		parity[rs.roots-1] = 0
+		if feedback != 0 {
+			for j := 0; j < rs.roots; j++ {
+				parity[j] ^= gfMul(feedback, rs.genpoly[rs.roots-1-j])
+			}
+		}
+	}
+}
+
+// decode corrects the codeword in place. erasures are positions of the symbols known to be corrupted.
+// It returns the number of corrected symbols.
+func (rs *rsCodec) decode(codeword []byte, erasures []int) (int, error) {
+	// position i of the codeword is the coefficient of x^(fecRSM-1-i)
+	locator := func(i int) int { return fecRSM - 1 - i }
+
+	syndromes := make([]byte, rs.roots)
+	nonzero := false
+	for i := range syndromes {
+		x := gfPow(i)
+		var s byte
+		for _, c := range codeword {
+			s = gfMul(s, x) ^ c
+		}
+		syndromes[i] = s
+		nonzero = nonzero || s != 0
+	}
+	if !nonzero {
+		return 0, nil
+	}
+	if len(erasures) > rs.roots {
+		return 0, fmt.Errorf("too many erasures")
+	}
+
+	// error locator polynomial is initialized with the erasure locator
+	lambda := make([]byte, rs.roots+1)
+	lambda[0] = 1
+	for i, e := range erasures {
+		x := gfPow(locator(e))
+		for j := i + 1; j > 0; j-- {
+			lambda[j] ^= gfMul(lambda[j-1], x)
+		}
+	}
+
+	// Berlekamp-Massey
+	b := append([]byte(nil), lambda...)
+	el := len(erasures)
+	for r := len(erasures) + 1; r <= rs.roots; r++ {
+		var discr byte
+		for i := 0; i < r; i++ {
+			discr ^= gfMul(lambda[i], syndromes[r-i-1])
+		}
+		// b = x*b
+		copy(b[1:], b[:rs.roots])
+		b[0] = 0
+		if discr == 0 {
+			continue
+		}
+		t := make([]byte, len(lambda))
+		for i := range t {
+			t[i] = lambda[i] ^ gfMul(discr, b[i])
+		}
+		if 2*el <= r+len(erasures)-1 {
+			el = r + len(erasures) - el
+			for i := range b {
+				b[i] = gfDiv(lambda[i], discr)
+			}
+		}
+		lambda = t
+	}
+
+	degree := 0
+	for i, c := range lambda {
+		if c != 0 {
+			degree = i
+		}
+	}
+
+	// Chien search, the roots of lambda are the inverses of the error locators
+	var positions []int
+	for i := range codeword {
+		if polyEval(lambda, gfPow(-locator(i))) == 0 {
+			positions = append(positions, i)
+		}
+	}
+	if degree == 0 || len(positions) != degree {
+		return 0, fmt.Errorf("uncorrectable codeword")
+	}
+
+	// omega = syndromes * lambda mod x^roots
+	omega := make([]byte, rs.roots)
+	for i := range omega {
+		for j := 0; j <= i; j++ {
+			omega[i] ^= gfMul(syndromes[j], lambda[i-j])
+		}
+	}
+
+	// Forney algorithm
+	for _, pos := range positions {
+		xInv := gfPow(-locator(pos))
+		// formal derivative of lambda evaluated at xInv, only odd powers remain in GF(2^m)
+		var den byte
+		for i := 1; i < len(lambda); i += 2 {
+			den ^= gfMul(lambda[i], gfPow(gfLog[xInv]*(i-1)))
+		}
+		if den == 0 {
+			return 0, fmt.Errorf("uncorrectable codeword")
+		}
+		num := gfMul(polyEval(omega, xInv), gfPow(locator(pos)))
+		codeword[pos] ^= gfDiv(num, den)
+	}
+	return len(positions), nil
+}
+
+// verityFEC describes the layout of the FEC data. The area covered by FEC consists of the data blocks followed
+// by the hash blocks and optional metadata from the hash device. Each byte of a block belongs to a different codeword,
+// and the symbols of a codeword are interleaved over the whole area, 'rounds' blocks apart from each other.
+type verityFEC struct {
+	rs         *rsCodec
+	roots      uint64
+	rsn        uint64 // number of data symbols in a codeword
+	blockSize  uint64
+	blocks     uint64 // number of blocks covered by FEC
+	rounds     uint64
+	start      uint64 // parity data position on the FEC device, in blocks
+	dataBlocks uint64
+	hashStart  uint64
+}
+
+func newVerityFEC(v VerityTable, tree *verityTree) (*verityFEC, error) {
+	if v.FECRoots < fecMinRoots || v.FECRoots > fecMaxRoots {
+		return nil, fmt.Errorf("verity FEC roots must be between %d and %d", fecMinRoots, fecMaxRoots)
+	}
+	if v.DataBlockSize != v.HashBlockSize {
+		return nil, fmt.Errorf("verity FEC requires the same data and hash block sizes")
+	}
+	// the kernel requires FEC to cover the data blocks and the hash tree
+	if hashBlocks := tree.hashEnd() - v.HashStartBlock; v.FECBlocks < v.NumDataBlocks+hashBlocks {
+		return nil, fmt.Errorf("verity FEC blocks %d do not cover %d data blocks and %d hash blocks", v.FECBlocks, v.NumDataBlocks, hashBlocks)
+	}
+	f := &verityFEC{
+		rs:         newRSCodec(int(v.FECRoots)),
+		roots:      v.FECRoots,
+		rsn:        fecRSM - v.FECRoots,
+		blockSize:  v.DataBlockSize,
+		blocks:     v.FECBlocks,
+		start:      v.FECStart,
+		dataBlocks: v.NumDataBlocks,
+		hashStart:  v.HashStartBlock,
+	}
+	f.rounds = (f.blocks + f.rsn - 1) / f.rsn
+	return f, nil
+}
+
+// readBlock reads the block at the given position of the area covered by FEC, blocks outside of the area are zeros
+func (f *verityFEC) readBlock(data, hash io.ReaderAt, position uint64, buf []byte) error {
+	switch {
+	case position >= f.blocks:
+		clear(buf)
+		return nil
+	case position < f.dataBlocks:
+		_, err := data.ReadAt(buf, int64(position*f.blockSize))
+		return err
+	default:
+		_, err := hash.ReadAt(buf, int64((position-f.dataBlocks+f.hashStart)*f.blockSize))
+		return err
+	}
+}
+
+// encode calculates the parity data for the whole area and writes it to the FEC device
+func (f *verityFEC) encode(data, hash io.ReaderAt, out io.WriterAt) error {
+	bufs := make([][]byte, f.rsn)
+	for i := range bufs {
+		bufs[i] = make([]byte, f.blockSize)
+	}
+	codeword := make([]byte, f.rsn)
+	parity := make([]byte, f.blockSize*f.roots)
+
+	for n := uint64(0); n < f.rounds; n++ {
+		for i := range bufs {
+			if err := f.readBlock(data, hash, n+uint64(i)*f.rounds, bufs[i]); err != nil {
+				return err
+			}
+		}
+		for j := uint64(0); j < f.blockSize; j++ {
+			for i := range bufs {
+				codeword[i] = bufs[i][j]
+			}
+			f.rs.encode(codeword, parity[j*f.roots:(j+1)*f.roots])
+		}
+		if _, err := out.WriteAt(parity, int64(f.start*f.blockSize+n*f.blockSize*f.roots)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// decode recovers the block at the given position of the area covered by FEC
+func (f *verityFEC) decode(data, hash, fec io.ReaderAt, position uint64) ([]byte, error) {
+	round, target := position%f.rounds, position/f.rounds
+
+	bufs := make([][]byte, f.rsn)
+	for i := range bufs {
+		bufs[i] = make([]byte, f.blockSize)
+		if uint64(i) == target {
+			continue // the corrupted block is an erasure
+		}
+		if err := f.readBlock(data, hash, round+uint64(i)*f.rounds, bufs[i]); err != nil {
+			return nil, err
+		}
+	}
+	parity := make([]byte, f.blockSize*f.roots)
+	if _, err := fec.ReadAt(parity, int64(f.start*f.blockSize+round*f.blockSize*f.roots)); err != nil {
+		return nil, err
+	}
+
+	codeword := make([]byte, fecRSM)
+	erasures := []int{int(target)}
+	for j := uint64(0); j < f.blockSize; j++ {
+		for i := range bufs {
+			codeword[i] = bufs[i][j]
+		}
+		copy(codeword[f.rsn:], parity[j*f.roots:(j+1)*f.roots])
+		if _, err := f.rs.decode(codeword, erasures); err != nil {
+			return nil, err
+		}
+		bufs[target][j] = codeword[target]
+	}
+	return bufs[target], nil
+}
+
+// formatFEC writes FEC parity data for the hash tree created by FormatVerity
+func formatFEC(v *VerityTable, tree *verityTree, data, hash *os.File) error {
+	if v.FECRoots == 0 {
+		v.FECRoots = 2
+	}
+	if v.FECBlocks == 0 {
+		v.FECBlocks = v.NumDataBlocks + tree.hashEnd() - v.HashStartBlock
+	}
+	if v.FECDevice == v.HashDevice && v.FECStart == 0 {
+		// place the parity data right after the hash tree
+		v.FECStart = tree.hashEnd()
+	}
+	f, err := newVerityFEC(*v, tree)
+	if err != nil {
+		return err
+	}
+
+	out, err := os.OpenFile(v.FECDevice, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	if err := f.encode(data, hash, out); err != nil {
+		return err
+	}
+	return out.Sync()
+}
@@ -0,0 +1,120 @@
+package devmapper
+
+import (
+	"crypto/rand"
+	mrand "math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRSCodec(t *testing.T) {
+	t.Parallel()
+
+	for _, roots := range []int{2, 3, 8, 24} {
+		rs := newRSCodec(roots)
+		codeword := make([]byte, fecRSM)
+		_, _ = rand.Read(codeword[:fecRSM-roots])
+		rs.encode(codeword[:fecRSM-roots], codeword[fecRSM-roots:])
+
+		// alpha^0..alpha^(roots-1) are the roots of every codeword polynomial
+		for i := 0; i < roots; i++ {
+			var s byte
+			for _, c := range codeword {
+				s = gfMul(s, gfPow(i)) ^ c
+			}
+			require.Zero(t, s)
+		}
+
+		check := func(errors, erasures int) {
+			corrupted := append([]byte(nil), codeword...)
+			positions := mrand.Perm(fecRSM)[:errors+erasures]
+			for _, p := range positions {
+				corrupted[p] ^= byte(1 + mrand.Intn(255))
+			}
+			n, err := rs.decode(corrupted, positions[:erasures])
+			require.NoError(t, err)
+			require.Equal(t, errors+erasures, n)
+			require.Equal(t, codeword, corrupted)
+		}
+		check(roots/2, 0)
+		check(0, roots)
+		check((roots-1)/2, 1)
+
+		n, err := rs.decode(codeword, nil)
+		require.NoError(t, err)
+		require.Zero(t, n)
+	}
+}
+
+func TestVerityFEC(t *testing.T) {
+	t.Parallel()
+
+	const blockSize = 512
+	dir := t.TempDir()
+	dataFile := filepath.Join(dir, "data")
+	hashFile := filepath.Join(dir, "hash")
+	fecFile := filepath.Join(dir, "fec")
+	data := make([]byte, 1000*blockSize)
+	_, _ = rand.Read(data)
+	require.NoError(t, os.WriteFile(dataFile, data, 0o600))
+	require.NoError(t, os.WriteFile(hashFile, nil, 0o600))
+	require.NoError(t, os.WriteFile(fecFile, nil, 0o600))
+
+	table, err := FormatVerity(VerityTable{
+		HashType:      1,
+		DataDevice:    dataFile,
+		HashDevice:    hashFile,
+		DataBlockSize: blockSize,
+		HashBlockSize: blockSize,
+		FECDevice:     fecFile,
+		FECRoots:      4,
+	}, VerityFormatOptions{})
+	require.NoError(t, err)
+	// 1000 data blocks, 63 + 4 + 1 hash blocks
+	require.Equal(t, uint64(1068), table.FECBlocks)
+
+	short := table
+	short.FECBlocks = 1067
+	_, err = OpenUserspaceVolume(os.O_RDONLY, 0, short)
+	require.ErrorContains(t, err, "do not cover", "FEC must cover the hash tree too")
+	rounds := (table.FECBlocks + 250) / 251
+	fi, err := os.Stat(fecFile)
+	require.NoError(t, err)
+	require.Equal(t, int64(rounds*blockSize*4), fi.Size())
+
+	read := func() ([]byte, error) {
+		vol, err := OpenUserspaceVolume(os.O_RDONLY, 0, table)
+		require.NoError(t, err)
+		defer vol.Close()
+
+		buf := make([]byte, len(data))
+		_, err = vol.ReadAt(buf, 0)
+		return buf, err
+	}
+
+	// wipe out a data block and a hash block, each codeword has 4 parity bytes so up to 4 erasures are recoverable
+	corrupted := append([]byte(nil), data...)
+	copy(corrupted[10*blockSize:11*blockSize], make([]byte, blockSize))
+	corrupted[(10+rounds)*blockSize+7] ^= 0xff
+	require.NoError(t, os.WriteFile(dataFile, corrupted, 0o600))
+	hash, err := os.ReadFile(hashFile)
+	require.NoError(t, err)
+	hash[3*blockSize] ^= 1
+	require.NoError(t, os.WriteFile(hashFile, hash, 0o600))
+
+	buf, err := read()
+	require.NoError(t, err)
+	require.Equal(t, data, buf)
+
+	// corruption of 3 blocks from the same codewords plus the erased block is too much for 4 roots
+	for i := uint64(2); i <= 3; i++ {
+		corrupted[(10+i*rounds)*blockSize] ^= 0xff
+		corrupted[(10+i*rounds)*blockSize+1] ^= 0xff
+	}
+	require.NoError(t, os.WriteFile(dataFile, corrupted, 0o600))
+	_, err = read()
+	require.Equal(t, &VerityCorruptionError{Device: dataFile, Block: 10}, err)
+}
@@ -0,0 +1,282 @@
+package devmapper
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+const (
+	veritySuperblockSize    = 512
+	veritySuperblockVersion = 1
+	veritySaltMaxSize       = 256
+)
+
+var veritySignature = [8]byte{'v', 'e', 'r', 'i', 't', 'y', 0, 0}
+
+// veritySuperblock is the on-disk superblock written by veritysetup at the beginning of the hash device,
+// see struct verity_sb in cryptsetup lib/verity/verity.c. All fields are little-endian.
+type veritySuperblock struct {
+	Signature     [8]byte
+	Version       uint32
+	HashType      uint32
+	UUID          [16]byte
+	Algorithm     [32]byte
+	DataBlockSize uint32
+	HashBlockSize uint32
+	DataBlocks    uint64
+	SaltSize      uint16
+	_             [6]byte
+	Salt          [veritySaltMaxSize]byte
+	_             [168]byte
+}
+
+// VerityFormatOptions controls FormatVerity behavior
+type VerityFormatOptions struct {
+	// Superblock writes veritysetup-compatible superblock to the hash device at HashStartBlock,
+	// the hash tree is placed right after it.
+	Superblock bool
+	// UUID is the hash device UUID stored in the superblock, a random one is generated if it is empty
+	UUID string
+}
+
+// FormatVerity calculates the dm-verity hash tree of the data device and writes it to the hash device,
+// the same as 'veritysetup format' does. The layout of the hash tree is defined by the table fields:
+// HashType, DataBlockSize, HashBlockSize, Algorithm, Salt, NumDataBlocks and HashStartBlock.
+// Zero block sizes mean 4096, an empty Algorithm means "sha256", an empty Salt means a random 32 bytes salt
+// ("-" means no salt) and zero NumDataBlocks means the whole data device.
+// If FECDevice is set then Reed-Solomon parity data is written to it the same way as 'veritysetup --fec-device' does.
+// Zero FECRoots means 2, zero FECBlocks means the data blocks and the hash tree. If FEC is stored on the hash device
+// and FECStart is zero then the parity data is placed right after the hash tree.
+// It returns the table with all the fields filled in, including Length and the root Digest.
+func FormatVerity(v VerityTable, opts VerityFormatOptions) (VerityTable, error) {
+	if v.DataBlockSize == 0 {
+		v.DataBlockSize = 4096
+	}
+	if v.HashBlockSize == 0 {
+		v.HashBlockSize = 4096
+	}
+	if v.Algorithm == "" {
+		v.Algorithm = "sha256"
+	}
+	if v.Salt == "" {
+		salt := make([]byte, 32)
+		if _, err := rand.Read(salt); err != nil {
+			return v, err
+		}
+		v.Salt = hex.EncodeToString(salt)
+	}
+
+	data, err := os.Open(v.DataDevice)
+	if err != nil {
+		return v, err
+	}
+	defer data.Close()
+
+	if v.NumDataBlocks == 0 {
+		size, err := data.Seek(0, io.SeekEnd)
+		if err != nil {
+			return v, err
+		}
+		if uint64(size)%v.DataBlockSize != 0 {
+			return v, fmt.Errorf("size of %s is not a multiple of the data block size %d", v.DataDevice, v.DataBlockSize)
+		}
+		v.NumDataBlocks = uint64(size) / v.DataBlockSize
+	}
+	v.Length = v.NumDataBlocks * v.DataBlockSize
+
+	hash, err := os.OpenFile(v.HashDevice, os.O_RDWR, 0)
+	if err != nil {
+		return v, err
+	}
+	defer hash.Close()
+
+	if opts.Superblock {
+		sb, err := newVeritySuperblock(v, opts.UUID)
+		if err != nil {
+			return v, err
+		}
+		var buf bytes.Buffer
+		if err := binary.Write(&buf, binary.LittleEndian, sb); err != nil {
+			return v, err
+		}
+		// the superblock occupies a full hash block
+		block := make([]byte, max(v.HashBlockSize, veritySuperblockSize))
+		copy(block, buf.Bytes())
+		if _, err := hash.WriteAt(block, int64(v.HashStartBlock*v.HashBlockSize)); err != nil {
+			return v, err
+		}
+		v.HashStartBlock += uint64(len(block)) / v.HashBlockSize
+	}
+
+	tree, err := newVerityTree(v)
+	if err != nil {
+		return v, err
+	}
+	root, err := tree.build(data, hash)
+	if err != nil {
+		return v, err
+	}
+	if err := hash.Sync(); err != nil {
+		return v, err
+	}
+	if v.FECDevice != "" {
+		if err := formatFEC(&v, tree, data, hash); err != nil {
+			return v, err
+		}
+	}
+	v.Digest = hex.EncodeToString(root)
+	return v, nil
+}
+
+// build calculates the hash tree level by level starting from the lowest one and returns the root digest
+func (t *verityTree) build(data io.ReaderAt, hash *os.File) ([]byte, error) {
+	if len(t.levelBlock) == 0 {
+		// a single data block, its digest is the root digest
+		block := make([]byte, t.dataBlockSize)
+		if _, err := data.ReadAt(block, 0); err != nil {
+			return nil, err
+		}
+		return t.digest(block), nil
+	}
+
+	src, srcBlockSize, srcStart, srcBlocks := data, t.dataBlockSize, uint64(0), t.dataBlocks
+	for level := range t.levelBlock {
+		if err := t.buildLevel(src, srcBlockSize, srcStart, srcBlocks, hash, t.levelBlock[level]); err != nil {
+			return nil, err
+		}
+		src, srcBlockSize, srcStart, srcBlocks = hash, t.hashBlockSize, t.levelBlock[level], t.levelBlocks(level)
+	}
+
+	// the top level consists of a single hash block
+	top := make([]byte, t.hashBlockSize)
+	if _, err := hash.ReadAt(top, int64(t.levelBlock[len(t.levelBlock)-1]*t.hashBlockSize)); err != nil {
+		return nil, err
+	}
+	return t.digest(top), nil
+}
+
+// buildLevel calculates digests of the source blocks and writes them as hash blocks starting at position dst
+func (t *verityTree) buildLevel(src io.ReaderAt, srcBlockSize, srcStart, srcBlocks uint64, hash io.WriterAt, dst uint64) error {
+	slotSize := t.digestSlot()
+	perBlock := uint64(1) << t.hashPerBlockBits
+
+	block := make([]byte, srcBlockSize)
+	hashBlock := make([]byte, t.hashBlockSize)
+	for i := uint64(0); i < srcBlocks; i++ {
+		if _, err := src.ReadAt(block, int64((srcStart+i)*srcBlockSize)); err != nil {
+			return err
+		}
+		copy(hashBlock[(i%perBlock)*slotSize:], t.digest(block))
+
+		if i%perBlock == perBlock-1 || i == srcBlocks-1 {
+			if _, err := hash.WriteAt(hashBlock, int64((dst+i/perBlock)*t.hashBlockSize)); err != nil {
+				return err
+			}
+			clear(hashBlock) // the unused digest slots are zero
+		}
+	}
+	return nil
+}
+
+func newVeritySuperblock(v VerityTable, uuid string) (*veritySuperblock, error) {
+	sb := &veritySuperblock{
+		Signature:     veritySignature,
+		Version:       veritySuperblockVersion,
+		HashType:      uint32(v.HashType),
+		DataBlockSize: uint32(v.DataBlockSize),
+		HashBlockSize: uint32(v.HashBlockSize),
+		DataBlocks:    v.NumDataBlocks,
+	}
+
+	if uuid == "" {
+		if _, err := rand.Read(sb.UUID[:]); err != nil {
+			return nil, err
+		}
+		sb.UUID[6] = sb.UUID[6]&0x0f | 0x40 // version 4
+		sb.UUID[8] = sb.UUID[8]&0x3f | 0x80 // RFC 4122 variant
+	} else {
+		raw, err := hex.DecodeString(strings.ReplaceAll(uuid, "-", ""))
+		if err != nil || len(raw) != len(sb.UUID) {
+			return nil, fmt.Errorf("invalid verity uuid '%s'", uuid)
+		}
+		copy(sb.UUID[:], raw)
+	}
+
+	if len(v.Algorithm) >= len(sb.Algorithm) {
+		return nil, fmt.Errorf("verity hash algorithm name '%s' is too long", v.Algorithm)
+	}
+	copy(sb.Algorithm[:], v.Algorithm)
+
+	if v.Salt != "-" {
+		salt, err := hex.DecodeString(v.Salt)
+		if err != nil {
+			return nil, fmt.Errorf("invalid verity salt: %v", err)
+		}
+		if len(salt) > veritySaltMaxSize {
+			return nil, fmt.Errorf("verity salt is too long")
+		}
+		sb.SaltSize = uint16(len(salt))
+		copy(sb.Salt[:], salt)
+	}
+	return sb, nil
+}
+
+// ReadVeritySuperblock reads the veritysetup superblock located at the given byte offset of the hash device
+// (0 unless the hash device was formatted with --hash-offset). It returns the table with all the fields
+// filled in except DataDevice and Digest, as well as the UUID stored in the superblock.
+func ReadVeritySuperblock(hashDevice string, offset uint64) (VerityTable, string, error) {
+	f, err := os.Open(hashDevice)
+	if err != nil {
+		return VerityTable{}, "", err
+	}
+	defer f.Close()
+
+	buf := make([]byte, veritySuperblockSize)
+	if _, err := f.ReadAt(buf, int64(offset)); err != nil {
+		return VerityTable{}, "", fmt.Errorf("unable to read verity superblock from %s: %v", hashDevice, err)
+	}
+	var sb veritySuperblock
+	if err := binary.Read(bytes.NewReader(buf), binary.LittleEndian, &sb); err != nil {
+		return VerityTable{}, "", err
+	}
+
+	if sb.Signature != veritySignature {
+		return VerityTable{}, "", fmt.Errorf("%s does not contain a verity superblock", hashDevice)
+	}
+	if sb.Version != veritySuperblockVersion {
+		return VerityTable{}, "", fmt.Errorf("unsupported verity superblock version %d", sb.Version)
+	}
+	if sb.SaltSize > veritySaltMaxSize {
+		return VerityTable{}, "", fmt.Errorf("invalid verity superblock salt size %d", sb.SaltSize)
+	}
+
+	v := VerityTable{
+		Length:        sb.DataBlocks * uint64(sb.DataBlockSize),
+		HashType:      uint64(sb.HashType),
+		HashDevice:    hashDevice,
+		DataBlockSize: uint64(sb.DataBlockSize),
+		HashBlockSize: uint64(sb.HashBlockSize),
+		NumDataBlocks: sb.DataBlocks,
+		Algorithm:     string(bytes.TrimRight(sb.Algorithm[:], "\x00")),
+		Salt:          "-",
+	}
+	if sb.SaltSize > 0 {
+		v.Salt = hex.EncodeToString(sb.Salt[:sb.SaltSize])
+	}
+	// validate the layout the same way the table is validated before use
+	if _, err := newVerityTree(v); err != nil {
+		return VerityTable{}, "", err
+	}
+	// the hash tree starts at the first hash block after the superblock
+	v.HashStartBlock = (offset + veritySuperblockSize + v.HashBlockSize - 1) / v.HashBlockSize
+
+	u := sb.UUID
+	uuid := fmt.Sprintf("%x-%x-%x-%x-%x", u[0:4], u[4:6], u[6:8], u[8:10], u[10:16])
+	return v, uuid, nil
+}
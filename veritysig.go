@@ -0,0 +1,298 @@
+package devmapper
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"fmt"
+	"math/big"
+
+	"golang.org/x/sys/unix"
+)
+
+// Keyring holds verity root hash signatures while the tables that refer to them are loaded. A client that talks
+// to the kernel adds the signatures to the process keyring as 'user' keys. A client with a custom Transport
+// supports root hash signatures only if the Transport implements Keyring.
+type Keyring interface {
+	AddKey(desc string, payload []byte) (int, error)
+	SearchKey(desc string) (int, error)
+	UnlinkKey(id int) error
+}
+
+// processKeyring is the kernel process keyring
+type processKeyring struct{}
+
+func (processKeyring) AddKey(desc string, payload []byte) (int, error) {
+	return unix.AddKey("user", desc, payload, unix.KEY_SPEC_PROCESS_KEYRING)
+}
+
+// SearchKey looks up the key in the same keyrings as the kernel does when it loads a verity table
+func (processKeyring) SearchKey(desc string) (int, error) {
+	var err error
+	for _, keyring := range []int{unix.KEY_SPEC_THREAD_KEYRING, unix.KEY_SPEC_PROCESS_KEYRING, unix.KEY_SPEC_SESSION_KEYRING} {
+		var id int
+		if id, err = unix.KeyctlSearch(keyring, "user", desc, 0); err == nil {
+			return id, nil
+		}
+	}
+	return 0, err
+}
+
+func (processKeyring) UnlinkKey(id int) error {
+	_, err := unix.KeyctlInt(unix.KEYCTL_UNLINK, id, unix.KEY_SPEC_PROCESS_KEYRING, 0, 0)
+	return err
+}
+
+// keyring returns the keyring for the verity root hash signatures, nil if the transport does not provide one
+func (c *Client) keyring() Keyring {
+	if c.controlPath != "" {
+		return processKeyring{}
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if k, ok := c.transport.(Keyring); ok {
+		return k
+	}
+	return nil
+}
+
+// addRootHashSigKeys adds root hash signatures of the verity tables to the keyring,
+// the kernel looks up the signature by the key description when the table is loaded.
+// It returns the tables that reference the keys and the ids of the added keys.
+// An existing key is never replaced, so the caller can unlink the added keys once the tables are loaded.
+func addRootHashSigKeys(k Keyring, name string, tables []Table) ([]Table, []int, error) {
+	var keys []int
+	result := make([]Table, len(tables))
+	for i, t := range tables {
+		result[i] = t
+		v, ok := t.(VerityTable)
+		if !ok || v.RootHashSig == nil {
+			continue
+		}
+		if k == nil {
+			return nil, nil, fmt.Errorf("the client transport does not support verity root hash signatures")
+		}
+		if v.RootHashSigKeyDesc == "" {
+			v.RootHashSigKeyDesc = fmt.Sprintf("devmapper:verity:%s:%d", name, i)
+		}
+		if _, err := k.SearchKey(v.RootHashSigKeyDesc); err == nil {
+			unlinkKeys(k, keys)
+			return nil, nil, fmt.Errorf("keyring key '%s' already exists", v.RootHashSigKeyDesc)
+		}
+		id, err := k.AddKey(v.RootHashSigKeyDesc, v.RootHashSig)
+		if err != nil {
+			unlinkKeys(k, keys)
+			return nil, nil, fmt.Errorf("unable to add verity root hash signature to the keyring: %v", err)
+		}
+		keys = append(keys, id)
+		result[i] = v
+	}
+	return result, keys, nil
+}
+
+// dropMissingKeys clears RootHashSigKeyDesc of the verity tables whose key is not in the keyring anymore, e.g. the key
+// added by Load is unlinked once the table is loaded, so that the tables can be loaded again
+func dropMissingKeys(k Keyring, tables []Table) {
+	if k == nil {
+		return
+	}
+	for i, t := range tables {
+		v, ok := t.(VerityTable)
+		if !ok || v.RootHashSigKeyDesc == "" {
+			continue
+		}
+		if _, err := k.SearchKey(v.RootHashSigKeyDesc); err != nil {
+			v.RootHashSigKeyDesc = ""
+			tables[i] = v
+		}
+	}
+}
+
+func unlinkKeys(k Keyring, keys []int) {
+	for _, id := range keys {
+		_ = k.UnlinkKey(id)
+	}
+}
+
+var (
+	oidSignedData    = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 2}
+	oidMessageDigest = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 4}
+)
+
+var pkcs7DigestAlgorithms = map[string]crypto.Hash{
+	"1.3.14.3.2.26":          crypto.SHA1,
+	"2.16.840.1.101.3.4.2.4": crypto.SHA224,
+	"2.16.840.1.101.3.4.2.1": crypto.SHA256,
+	"2.16.840.1.101.3.4.2.2": crypto.SHA384,
+	"2.16.840.1.101.3.4.2.3": crypto.SHA512,
+}
+
+type pkcs7ContentInfo struct {
+	ContentType asn1.ObjectIdentifier
+	Content     asn1.RawValue `asn1:"explicit,optional,tag:0"`
+}
+
+type pkcs7SignedData struct {
+	Version          int
+	DigestAlgorithms []pkix.AlgorithmIdentifier `asn1:"set"`
+	ContentInfo      pkcs7ContentInfo
+	Certificates     asn1.RawValue     `asn1:"optional,tag:0"`
+	CRLs             asn1.RawValue     `asn1:"optional,tag:1"`
+	SignerInfos      []pkcs7SignerInfo `asn1:"set"`
+}
+
+type pkcs7IssuerAndSerial struct {
+	Issuer       asn1.RawValue
+	SerialNumber *big.Int
+}
+
+type pkcs7SignerInfo struct {
+	Version                   int
+	IssuerAndSerial           pkcs7IssuerAndSerial
+	DigestAlgorithm           pkix.AlgorithmIdentifier
+	AuthenticatedAttributes   asn1.RawValue `asn1:"optional,tag:0"`
+	DigestEncryptionAlgorithm pkix.AlgorithmIdentifier
+	EncryptedDigest           []byte
+	UnauthenticatedAttributes asn1.RawValue `asn1:"optional,tag:1"`
+}
+
+type pkcs7Attribute struct {
+	Type   asn1.ObjectIdentifier
+	Values asn1.RawValue `asn1:"set"`
+}
+
+// VerifyVerityRootHashSignature checks the PKCS#7 detached signature of the verity root hash the same way the kernel
+// does it for 'root_hash_sig_key_desc': the signed content is the hex-encoded root digest as it is passed in the table.
+// The signer certificate must be one of the trusted certificates (an equivalent of the kernel trusted keyring) or
+// be included into the signature and chain up to one of the trusted certificates, possibly via intermediate
+// certificates included into the signature. Like in the kernel, expired certificates are accepted.
+func VerifyVerityRootHashSignature(digest string, sig []byte, trusted []*x509.Certificate) error {
+	var info pkcs7ContentInfo
+	if rest, err := asn1.Unmarshal(sig, &info); err != nil || len(rest) != 0 {
+		return fmt.Errorf("invalid PKCS#7 signature")
+	}
+	if !info.ContentType.Equal(oidSignedData) {
+		return fmt.Errorf("PKCS#7 signature is not a signed data")
+	}
+	var sd pkcs7SignedData
+	if _, err := asn1.Unmarshal(info.Content.Bytes, &sd); err != nil {
+		return fmt.Errorf("invalid PKCS#7 signed data: %v", err)
+	}
+	if len(sd.SignerInfos) == 0 {
+		return fmt.Errorf("PKCS#7 signature has no signers")
+	}
+
+	var embedded []*x509.Certificate
+	if len(sd.Certificates.Bytes) != 0 {
+		var err error
+		embedded, err = x509.ParseCertificates(sd.Certificates.Bytes)
+		if err != nil {
+			return fmt.Errorf("invalid PKCS#7 certificates: %v", err)
+		}
+	}
+
+	for _, si := range sd.SignerInfos {
+		cert, err := signerCertificate(si, trusted, embedded)
+		if err != nil {
+			return err
+		}
+		if err := verifySignerInfo(si, cert, []byte(digest)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// signerCertificate finds the certificate of the signer and checks that it is trusted
+func signerCertificate(si pkcs7SignerInfo, trusted, embedded []*x509.Certificate) (*x509.Certificate, error) {
+	matches := func(c *x509.Certificate) bool {
+		return bytes.Equal(c.RawIssuer, si.IssuerAndSerial.Issuer.FullBytes) && c.SerialNumber.Cmp(si.IssuerAndSerial.SerialNumber) == 0
+	}
+
+	for _, c := range trusted {
+		if matches(c) {
+			return c, nil
+		}
+	}
+
+	roots := x509.NewCertPool()
+	for _, c := range trusted {
+		roots.AddCert(c)
+	}
+	intermediates := x509.NewCertPool()
+	for _, c := range embedded {
+		intermediates.AddCert(c)
+	}
+	for _, c := range embedded {
+		if !matches(c) {
+			continue
+		}
+		opts := x509.VerifyOptions{
+			Roots:         roots,
+			Intermediates: intermediates,
+			// the kernel does not check the certificate validity period, verify the chain at the time the signer was issued
+			CurrentTime: c.NotBefore,
+			KeyUsages:   []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+		}
+		if _, err := c.Verify(opts); err != nil {
+			return nil, fmt.Errorf("PKCS#7 signer certificate is not trusted: %v", err)
+		}
+		return c, nil
+	}
+	return nil, fmt.Errorf("PKCS#7 signer certificate is not trusted")
+}
+
+func verifySignerInfo(si pkcs7SignerInfo, cert *x509.Certificate, content []byte) error {
+	hash, ok := pkcs7DigestAlgorithms[si.DigestAlgorithm.Algorithm.String()]
+	if !ok {
+		return fmt.Errorf("unsupported PKCS#7 digest algorithm %v", si.DigestAlgorithm.Algorithm)
+	}
+	h := hash.New()
+	h.Write(content)
+	contentDigest := h.Sum(nil)
+
+	signed := contentDigest
+	if len(si.AuthenticatedAttributes.Bytes) != 0 {
+		// the signature covers the authenticated attributes that contain the content digest, the attributes
+		// are signed as an explicit SET OF rather than the implicitly tagged field
+		encoded := append([]byte(nil), si.AuthenticatedAttributes.FullBytes...)
+		encoded[0] = 0x31
+		var attrs []pkcs7Attribute
+		if _, err := asn1.UnmarshalWithParams(encoded, &attrs, "set"); err != nil {
+			return fmt.Errorf("invalid PKCS#7 authenticated attributes: %v", err)
+		}
+		var messageDigest []byte
+		for _, a := range attrs {
+			if a.Type.Equal(oidMessageDigest) {
+				if _, err := asn1.Unmarshal(a.Values.Bytes, &messageDigest); err != nil {
+					return fmt.Errorf("invalid PKCS#7 message digest: %v", err)
+				}
+			}
+		}
+		if !bytes.Equal(messageDigest, contentDigest) {
+			return fmt.Errorf("PKCS#7 message digest does not match the root hash")
+		}
+
+		h := hash.New()
+		h.Write(encoded)
+		signed = h.Sum(nil)
+	}
+
+	switch pub := cert.PublicKey.(type) {
+	case *rsa.PublicKey:
+		if err := rsa.VerifyPKCS1v15(pub, hash, signed, si.EncryptedDigest); err != nil {
+			return fmt.Errorf("verity root hash signature verification failed: %v", err)
+		}
+	case *ecdsa.PublicKey:
+		if !ecdsa.VerifyASN1(pub, signed, si.EncryptedDigest) {
+			return fmt.Errorf("verity root hash signature verification failed")
+		}
+	default:
+		return fmt.Errorf("unsupported PKCS#7 signer key type %T", cert.PublicKey)
+	}
+	return nil
+}
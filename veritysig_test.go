@@ -0,0 +1,121 @@
+package devmapper
+
+import (
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// the test vectors are generated with
+//
+//	openssl req -x509 -newkey ec -pkeyopt ec_paramgen_curve:P-256 -nodes -keyout key.pem -out cert.pem -subj "/CN=verity test"
+//	openssl smime -sign -nocerts -noattr -binary -in roothash.txt -inkey key.pem -signer cert.pem -outform der -out sig.der
+//	openssl smime -sign -binary -in roothash.txt -inkey key.pem -signer cert.pem -outform der -out sig.der
+//
+// the chain vector is signed by an expired certificate issued by an intermediate CA, the CA certificates are
+// created with 'openssl ca -extensions v3_ca -startdate 20200101000000Z -enddate 21200101000000Z' and the signer with
+// 'openssl ca -startdate 20200101000000Z -enddate 20210101000000Z', the intermediate CA is included into the signature:
+//
+//	openssl smime -sign -noattr -binary -in roothash.txt -inkey leaf.key -signer leaf.pem -certfile inter.pem -outform der -out sig.der
+const (
+	signedRootHash = "4392712ba01368efdf14b05c76f9e4df0d53664630b5d48632ed17a137f39076"
+	signerCert     = `-----BEGIN CERTIFICATE-----
+MIIBgTCCASigAwIBAgITBruANKwI3nf9phni0lDsdOneXTAKBggqhkjOPQQDAjAW
+MRQwEgYDVQQDDAt2ZXJpdHkgdGVzdDAgFw0yNjEwMTgwNzA4MzNaGA8yMTI2MDky
+NDA3MDgzM1owFjEUMBIGA1UEAwwLdmVyaXR5IHRlc3QwWTATBgcqhkjOPQIBBggq
+hkjOPQMBBwNCAATrRoYtYZBGYEDLzojE/kfcUgR1TaoKnncJH3E7cA12HX8Yn4f9
+FNriK/y40rFqS4rqqSWJ2+plcJojxF/ZM0Hlo1MwUTAdBgNVHQ4EFgQUNijH2fOp
+bMmBDX4rPGlATIuXkiYwHwYDVR0jBBgwFoAUNijH2fOpbMmBDX4rPGlATIuXkiYw
+DwYDVR0TAQH/BAUwAwEB/zAKBggqhkjOPQQDAgNHADBEAiBkA29mDB1125bHN6r6
+gnw5Y8eNmNF42UjvH+uByn7zkgIgXP38zaQelN7zK0FVq9wHUxpvPofV7NI9Xg3k
+BQhjbwQ=
+-----END CERTIFICATE-----
+`
+	otherCert = `-----BEGIN CERTIFICATE-----
+MIIBdjCCAR2gAwIBAgIUawp/CoBccT/JYau6kVnsHQ7qkVowCgYIKoZIzj0EAwIw
+EDEOMAwGA1UEAwwFb3RoZXIwIBcNMjYxMDE4MDcwODMzWhgPMjEyNjA5MjQwNzA4
+MzNaMBAxDjAMBgNVBAMMBW90aGVyMFkwEwYHKoZIzj0CAQYIKoZIzj0DAQcDQgAE
+6c13U7X7VHxj++Bvon5Wv+vMJvI9OzyI6RzVYDmQ28okZTtNL1DIONnN6cqtkxlu
+jTdH2QdJa8iipEiBh6S6v6NTMFEwHQYDVR0OBBYEFIJRZrWc1Vft3UG1KxxcFFgZ
+4CFYMB8GA1UdIwQYMBaAFIJRZrWc1Vft3UG1KxxcFFgZ4CFYMA8GA1UdEwEB/wQF
+MAMBAf8wCgYIKoZIzj0EAwIDRwAwRAIgNFenMa7xNTN7R+3qx5hlC/IwIMjkOod2
+yV/qZ27Anm0CIHYHV59AfjUX/Qq9mZq7Zgw1OGglpygGGLi2r0a0BBrc
+-----END CERTIFICATE-----
+`
+	sigNoAttrs = "MIHOBgkqhkiG9w0BBwKggcAwgb0CAQExDzANBglghkgBZQMEAgEFADALBgkqhkiG9w0BBwExgZkwgZYCAQEwLTAWMRQwEgYDVQQD" +
+		"DAt2ZXJpdHkgdGVzdAITBruANKwI3nf9phni0lDsdOneXTANBglghkgBZQMEAgEFADAKBggqhkjOPQQDAgRHMEUCIQDy4SxPHTyo" +
+		"o79vFjvRppLY5nUVkPW43Iuycv8tv713OgIgccdKbXQVPy0+C/fPmapN8y1KcNvNjkl8IhlhXVZwLs4="
+	sigWithAttrs = "MIIDQgYJKoZIhvcNAQcCoIIDMzCCAy8CAQExDzANBglghkgBZQMEAgEFADALBgkqhkiG9w0BBwGgggGFMIIBgTCCASigAwIBAgIT" +
+		"BruANKwI3nf9phni0lDsdOneXTAKBggqhkjOPQQDAjAWMRQwEgYDVQQDDAt2ZXJpdHkgdGVzdDAgFw0yNjEwMTgwNzA4MzNaGA8y" +
+		"MTI2MDkyNDA3MDgzM1owFjEUMBIGA1UEAwwLdmVyaXR5IHRlc3QwWTATBgcqhkjOPQIBBggqhkjOPQMBBwNCAATrRoYtYZBGYEDL" +
+		"zojE/kfcUgR1TaoKnncJH3E7cA12HX8Yn4f9FNriK/y40rFqS4rqqSWJ2+plcJojxF/ZM0Hlo1MwUTAdBgNVHQ4EFgQUNijH2fOp" +
+		"bMmBDX4rPGlATIuXkiYwHwYDVR0jBBgwFoAUNijH2fOpbMmBDX4rPGlATIuXkiYwDwYDVR0TAQH/BAUwAwEB/zAKBggqhkjOPQQD" +
+		"AgNHADBEAiBkA29mDB1125bHN6r6gnw5Y8eNmNF42UjvH+uByn7zkgIgXP38zaQelN7zK0FVq9wHUxpvPofV7NI9Xg3kBQhjbwQx" +
+		"ggGBMIIBfQIBATAtMBYxFDASBgNVBAMMC3Zlcml0eSB0ZXN0AhMGu4A0rAjed/2mGeLSUOx06d5dMA0GCWCGSAFlAwQCAQUAoIHk" +
+		"MBgGCSqGSIb3DQEJAzELBgkqhkiG9w0BBwEwHAYJKoZIhvcNAQkFMQ8XDTI2MTAxODA3MDgzM1owLwYJKoZIhvcNAQkEMSIEID0t" +
+		"2QWUwwBObleLvSvRV+Pf772uKwQIiNPrFCcItmw9MHkGCSqGSIb3DQEJDzFsMGowCwYJYIZIAWUDBAEqMAsGCWCGSAFlAwQBFjAL" +
+		"BglghkgBZQMEAQIwCgYIKoZIhvcNAwcwDgYIKoZIhvcNAwICAgCAMA0GCCqGSIb3DQMCAgFAMAcGBSsOAwIHMA0GCCqGSIb3DQMC" +
+		"AgEoMAoGCCqGSM49BAMCBEcwRQIgGldilPAZw+r/mqahlKT7OqNsHqcEBwpkx54Jz+3jnFgCIQChTgXEAqntr5dDCOQgjTsX4YY8" +
+		"GGmebuo4GQv3dQ7I/w=="
+	rootCACert = `-----BEGIN CERTIFICATE-----
+MIIBWzCCAQKgAwIBAgIBATAKBggqhkjOPQQDAjAWMRQwEgYDVQQDDAt2ZXJpdHkg
+cm9vdDAgFw0yMDAxMDEwMDAwMDBaGA8yMTIwMDEwMTAwMDAwMFowFjEUMBIGA1UE
+AwwLdmVyaXR5IHJvb3QwWTATBgcqhkjOPQIBBggqhkjOPQMBBwNCAATlOiBs6F23
+trKwjLaBdXcr27XKONfa0KUlkj0Ilu4fWxfL+WHqEkdY2wgZloh+5+flc0qznv3H
+Ioy9LKv3Kcmloz8wPTAPBgNVHRMBAf8EBTADAQH/MAsGA1UdDwQEAwICBDAdBgNV
+HQ4EFgQUL1lDRsSWKWnglcmfhOJsyoMmIcowCgYIKoZIzj0EAwIDRwAwRAIgfcO4
+98/wm6vYS5SK3Kb+aXWK5tY3wSasRl9hqgadoxkCIE5Z1YQIQfjo62FHl0NG59+q
+CWEZhA8E5Nqnj5Xs47Ks
+-----END CERTIFICATE-----
+`
+	sigChain = "MIIDXQYJKoZIhvcNAQcCoIIDTjCCA0oCAQExDzANBglghkgBZQMEAgEFADALBgkqhkiG9w0BBwGgggKZMIIBfTCCASSgAwIBAgIB" +
+		"AjAKBggqhkjOPQQDAjAWMRQwEgYDVQQDDAt2ZXJpdHkgcm9vdDAgFw0yMDAxMDEwMDAwMDBaGA8yMTIwMDEwMTAwMDAwMFowFzEV" +
+		"MBMGA1UEAwwMdmVyaXR5IGludGVyMFkwEwYHKoZIzj0CAQYIKoZIzj0DAQcDQgAE1wT5y+x07pHSqcge/2e7ysUfpYoNq8xj/xZo" +
+		"Jqcr9yK3QIKOLXBKNiW7EwDneAEFacw5wIn9rsE3PHmxi/D7iKNgMF4wDwYDVR0TAQH/BAUwAwEB/zALBgNVHQ8EBAMCAgQwHQYD" +
+		"VR0OBBYEFJe9NLGFRvZjZrmYE4P4yf8W7+NNMB8GA1UdIwQYMBaAFC9ZQ0bElilp4JXJn4TibMqDJiHKMAoGCCqGSM49BAMCA0cA" +
+		"MEQCIDti+9ShPHkbekdHw5ez2qt5wpnq4MPsjHzDO2RM78M7AiB0efotReYLmq3v4PhQcSodp8ZK0S3ZvD+dZTbElnMWajCCARQw" +
+		"gbsCAQMwCgYIKoZIzj0EAwIwFzEVMBMGA1UEAwwMdmVyaXR5IGludGVyMB4XDTIwMDEwMTAwMDAwMFoXDTIxMDEwMTAwMDAwMFow" +
+		"FjEUMBIGA1UEAwwLdmVyaXR5IGxlYWYwWTATBgcqhkjOPQIBBggqhkjOPQMBBwNCAAQpfqGP1DRfXRvO1gAh2Nrws4TLg2YgX0bR" +
+		"RtOIpgNSqwY0r6gBgBVjoJypMB+3Z9kmkAl9W5JPx0mhiBZ7YAdkMAoGCCqGSM49BAMCA0gAMEUCIQCjEo9Ywstk3ixKP4LnXuAs" +
+		"eHWGSTiranfuVX6RQ0RFMwIgJKslwzQ+LbyUfOrbn5IpYLn6z561K9Vq6AHuP9pyCV0xgYkwgYYCAQEwHDAXMRUwEwYDVQQDDAx2" +
+		"ZXJpdHkgaW50ZXICAQMwDQYJYIZIAWUDBAIBBQAwCgYIKoZIzj0EAwIESDBGAiEAraRLYMMOVYySi06RyYmxWmAuA4roS6KucwZf" +
+		"Ec6Jo4gCIQDg6zGR8Hi2Dhs1FAoBSjSP5Y6HAhZtmZl/2XU4ApRMUg=="
+)
+
+func parseTestCert(t *testing.T, data string) *x509.Certificate {
+	block, _ := pem.Decode([]byte(data))
+	require.NotNil(t, block)
+	cert, err := x509.ParseCertificate(block.Bytes)
+	require.NoError(t, err)
+	return cert
+}
+
+func TestVerifyVerityRootHashSignature(t *testing.T) {
+	t.Parallel()
+
+	signer := parseTestCert(t, signerCert)
+	other := parseTestCert(t, otherCert)
+
+	for _, s := range []string{sigNoAttrs, sigWithAttrs} {
+		sig, err := base64.StdEncoding.DecodeString(s)
+		require.NoError(t, err)
+
+		require.NoError(t, VerifyVerityRootHashSignature(signedRootHash, sig, []*x509.Certificate{other, signer}))
+		require.ErrorContains(t, VerifyVerityRootHashSignature(signedRootHash, sig, []*x509.Certificate{other}), "not trusted")
+		require.Error(t, VerifyVerityRootHashSignature("0"+signedRootHash[1:], sig, []*x509.Certificate{signer}))
+
+		sig[len(sig)-1] ^= 1
+		require.Error(t, VerifyVerityRootHashSignature(signedRootHash, sig, []*x509.Certificate{signer}))
+	}
+
+	require.Error(t, VerifyVerityRootHashSignature(signedRootHash, []byte("garbage"), []*x509.Certificate{signer}))
+
+	sig, err := base64.StdEncoding.DecodeString(sigChain)
+	require.NoError(t, err)
+	root := parseTestCert(t, rootCACert)
+	require.NoError(t, VerifyVerityRootHashSignature(signedRootHash, sig, []*x509.Certificate{root}), "expired signer issued by an intermediate CA")
+	require.ErrorContains(t, VerifyVerityRootHashSignature(signedRootHash, sig, []*x509.Certificate{other}), "not trusted")
+}
@@ -4,6 +4,12 @@ import (
 	"fmt"
 	"io"
 	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"golang.org/x/sys/unix"
 )
 
 // Volume represents reader/writer for the data handled by the device mapper table.
@@ -143,3 +149,97 @@ func OpenUserspaceVolume(flag int, perm fs.FileMode, tables ...Table) (Volume, e
 
 	return &combinedVolume{ranges: ranges}, nil
 }
+
+// OpenVolume is a wrapper around Client.OpenVolume that uses the default client.
+func OpenVolume(name string, flag int, perm fs.FileMode) (Volume, error) {
+	return defaultClient.OpenVolume(name, flag, perm)
+}
+
+// OpenVolume opens the block device of an active device mapper device, i.e. the data is processed by the kernel.
+// The device node is looked up at /dev/mapper/<name> and /dev/dm-<minor>.
+// flag and perm parameters are applied to os.OpenFile() the same way as for OpenUserspaceVolumeByName,
+// e.g. os.O_RDONLY|unix.O_DIRECT opens the device for direct I/O. Write access to a read-only device is refused.
+// Use OpenUserspaceVolumeByName to process the same data in userspace.
+func (c *Client) OpenVolume(name string, flag int, perm fs.FileMode) (Volume, error) {
+	info, err := c.InfoByName(name)
+	if err != nil {
+		return nil, err
+	}
+	if info.Flags&unix.DM_ACTIVE_PRESENT_FLAG == 0 {
+		return nil, fmt.Errorf("device %s has no live table", name)
+	}
+	if info.Flags&unix.DM_READONLY_FLAG != 0 && flag&(os.O_WRONLY|os.O_RDWR) != 0 {
+		return nil, fmt.Errorf("device %s is read-only", name)
+	}
+
+	candidates := []string{filepath.Join(mapperDir, name), fmt.Sprintf("/dev/dm-%d", unix.Minor(info.DevNo))}
+	for _, path := range candidates {
+		var st unix.Stat_t
+		if err := unix.Stat(path, &st); err != nil || st.Mode&unix.S_IFMT != unix.S_IFBLK || uint64(st.Rdev) != info.DevNo {
+			continue
+		}
+		return os.OpenFile(path, flag, perm)
+	}
+	return nil, fmt.Errorf("unable to find block device node for %s (%d:%d)", name, unix.Major(info.DevNo), unix.Minor(info.DevNo))
+}
+
+// OpenUserspaceVolumeByName is a wrapper around Client.OpenUserspaceVolumeByName that uses the default client.
+func OpenUserspaceVolumeByName(name string, flag int, perm fs.FileMode) (Volume, error) {
+	return defaultClient.OpenUserspaceVolumeByName(name, flag, perm)
+}
+
+// OpenUserspaceVolumeByName reads the live table of the device from the kernel and opens it with OpenUserspaceVolume,
+// e.g. to compare the data processed by the kernel and the userspace implementation.
+// The underlying devices reported by the kernel in "major:minor" format are resolved to /dev paths.
+func (c *Client) OpenUserspaceVolumeByName(name string, flag int, perm fs.FileMode) (Volume, error) {
+	tables, err := c.Tables(name, false)
+	if err != nil {
+		return nil, err
+	}
+	if len(tables) == 0 {
+		return nil, fmt.Errorf("device %s has no live table", name)
+	}
+	for i, t := range tables {
+		tables[i] = resolveDevices(t)
+	}
+	return OpenUserspaceVolume(flag, perm, tables...)
+}
+
+// resolveDevices replaces "major:minor" device references in the table with device paths
+func resolveDevices(t Table) Table {
+	switch t := t.(type) {
+	case LinearTable:
+		t.BackendDevice = devicePath(t.BackendDevice)
+		return t
+	case CryptTable:
+		t.BackendDevice = devicePath(t.BackendDevice)
+		return t
+	case VerityTable:
+		t.DataDevice = devicePath(t.DataDevice)
+		t.HashDevice = devicePath(t.HashDevice)
+		if t.FECDevice != "" {
+			t.FECDevice = devicePath(t.FECDevice)
+		}
+		return t
+	}
+	return t
+}
+
+var devnoRe = regexp.MustCompile(`^\d+:\d+$`)
+
+// devicePath converts "major:minor" into the device path using sysfs, other values are returned as is
+func devicePath(dev string) string {
+	if !devnoRe.MatchString(dev) {
+		return dev
+	}
+	uevent, err := os.ReadFile("/sys/dev/block/" + dev + "/uevent")
+	if err != nil {
+		return dev
+	}
+	for _, line := range strings.Split(string(uevent), "\n") {
+		if devname, ok := strings.CutPrefix(line, "DEVNAME="); ok {
+			return "/dev/" + devname
+		}
+	}
+	return dev
+}
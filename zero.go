@@ -1,6 +1,9 @@
 package devmapper
 
-import "io/fs"
+import (
+	"fmt"
+	"io/fs"
+)
 
 // ZeroTable represents information needed for 'zero' target creation
 type ZeroTable struct {
@@ -24,6 +27,13 @@ func (z ZeroTable) targetType() string {
 	return "zero"
 }
 
+func parseZeroTable(start, length uint64, params string) (Table, error) {
+	if params != "" {
+		return nil, fmt.Errorf("zero target does not accept parameters")
+	}
+	return ZeroTable{Start: start, Length: length}, nil
+}
+
 type zeroVolume struct{}
 
 func (z ZeroTable) openVolume(flag int, perm fs.FileMode) (Volume, error) {